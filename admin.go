@@ -0,0 +1,223 @@
+package coredns_omada
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordEntry is a record served by the plugin as shown by the admin api
+type recordEntry struct {
+	zone      string
+	rr        dns.RR
+	timestamp time.Time
+	recordInfo
+}
+
+// refreshStatus is the outcome of the last zone refresh
+type refreshStatus struct {
+	LastAttempt   time.Time `json:"last_attempt"`
+	LastSuccess   time.Time `json:"last_success"`
+	Duration      string    `json:"duration"`
+	Error         string    `json:"error,omitempty"`
+	FailedSources []string  `json:"failed_sources,omitempty"`
+}
+
+// recordJSON is the json representation of a record in the admin api
+type recordJSON struct {
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	TTL        uint32     `json:"ttl"`
+	Value      string     `json:"value"`
+	Source     string     `json:"source"`
+	MAC        string     `json:"mac,omitempty"`
+	Site       string     `json:"site,omitempty"`
+	Timestamp  *time.Time `json:"timestamp,omitempty"`
+	AgeSeconds *float64   `json:"age_seconds,omitempty"`
+}
+
+// recordsJSON is the response of the records endpoint
+type recordsJSON struct {
+	Refresh refreshStatus           `json:"refresh"`
+	Zones   map[string][]recordJSON `json:"zones"`
+}
+
+// setRefreshStatus records the outcome of a zone refresh which started at start
+func (o *Omada) setRefreshStatus(start time.Time, failures []error, err error) {
+
+	status := refreshStatus{
+		LastAttempt: start,
+		Duration:    time.Since(start).String(),
+	}
+	for _, f := range failures {
+		status.FailedSources = append(status.FailedSources, f.Error())
+	}
+
+	o.zMu.Lock()
+	defer o.zMu.Unlock()
+	status.LastSuccess = o.status.LastSuccess
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.LastSuccess = start
+	}
+	o.status = status
+}
+
+// adminHandler returns the handler of the admin http api
+func (o *Omada) adminHandler() http.Handler {
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /records", func(w http.ResponseWriter, r *http.Request) {
+		o.zMu.RLock()
+		response := recordsJSON{Refresh: o.status, Zones: make(map[string][]recordJSON)}
+		entries := o.entries
+		o.zMu.RUnlock()
+
+		now := time.Now()
+		for _, e := range entries {
+			response.Zones[e.zone] = append(response.Zones[e.zone], e.json(now))
+		}
+		for _, zone := range response.Zones {
+			sort.Slice(zone, func(i, j int) bool {
+				if zone[i].Name != zone[j].Name {
+					return zone[i].Name < zone[j].Name
+				}
+				return zone[i].Type < zone[j].Type
+			})
+		}
+		writeJSON(w, response)
+	})
+	mux.HandleFunc("POST /refresh", func(w http.ResponseWriter, r *http.Request) {
+		if o.config.admin_token == "" {
+			http.Error(w, "refresh requires admin_token to be configured", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(o.config.admin_token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		queued := o.requestRefresh()
+		log.Infof("admin: refresh requested by %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, map[string]bool{"queued": queued})
+	})
+	mux.HandleFunc("GET /zones", func(w http.ResponseWriter, r *http.Request) {
+		o.zMu.RLock()
+		zoneNames := slices.Clone(o.zoneNames)
+		o.zMu.RUnlock()
+		sort.Strings(zoneNames)
+		writeJSON(w, zoneNames)
+	})
+	mux.HandleFunc("GET /zones/{zone}", func(w http.ResponseWriter, r *http.Request) {
+		zoneName := strings.ToLower(dns.Fqdn(r.PathValue("zone")))
+		o.zMu.RLock()
+		zone, ok := o.zones[zoneName]
+		var data []byte
+		var err error
+		if ok {
+			data, err = renderZoneFile(zoneName, zone)
+		}
+		o.zMu.RUnlock()
+		if !ok {
+			http.Error(w, "zone not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/dns")
+		w.Write(data)
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		o.zMu.RLock()
+		status := o.status
+		o.zMu.RUnlock()
+		writeJSON(w, status)
+	})
+	return mux
+}
+
+// json returns the admin api representation of a record
+func (e recordEntry) json(now time.Time) recordJSON {
+
+	hdr := e.rr.Header()
+	record := recordJSON{
+		Name:   hdr.Name,
+		Type:   dns.TypeToString[hdr.Rrtype],
+		TTL:    hdr.Ttl,
+		Value:  strings.TrimSpace(strings.TrimPrefix(e.rr.String(), hdr.String())),
+		Source: e.source,
+		MAC:    e.mac,
+		Site:   e.site,
+	}
+	if !e.timestamp.IsZero() {
+		timestamp := e.timestamp
+		age := now.Sub(timestamp).Seconds()
+		record.Timestamp = &timestamp
+		record.AgeSeconds = &age
+	}
+	return record
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warningf("admin: failed to write response: %v", err)
+	}
+}
+
+// adminServer serves the admin http api on its own listen address
+type adminServer struct {
+	addr    string
+	handler http.Handler
+	mu      sync.Mutex
+	srv     *http.Server
+}
+
+// start listens on the admin address and serves the api in the background
+func (a *adminServer) start() error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.srv != nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	a.srv = &http.Server{Handler: a.handler, ReadHeaderTimeout: 10 * time.Second}
+	go func(srv *http.Server) {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin: failed to serve on %s: %v", a.addr, err)
+		}
+	}(a.srv)
+	log.Infof("admin: listening on %s", a.addr)
+	return nil
+}
+
+// stop closes the admin listener so the address can be reused on reload
+func (a *adminServer) stop() error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.srv == nil {
+		return nil
+	}
+	err := a.srv.Close()
+	a.srv = nil
+	return err
+}
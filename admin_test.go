@@ -0,0 +1,187 @@
+package coredns_omada
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminRecords(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestAdminRecords/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.records = []dns.RR{
+		mustParseStaticRecord(t, "www.omada.home. 300 IN CNAME proxy.omada.home."),
+		mustParseStaticRecord(t, "client-001.omada.home. 300 IN A 10.0.0.200"),
+	}
+	testOmada.config.fallback = fallbackConfig{targets: []string{"10.0.0.1"}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestAdminRecords/controllerInit': %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	testOmada.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/records", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var response recordsJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	assert.Empty(t, response.Refresh.Error)
+	assert.False(t, response.Refresh.LastSuccess.IsZero())
+
+	records := make(map[string]recordJSON)
+	for _, r := range response.Zones["omada.home."] {
+		records[r.Name+" "+r.Type] = r
+	}
+	assert.Len(t, response.Zones["omada.home."], 16)
+
+	client := records["win10-vm.omada.home. A"]
+	assert.Equal(t, "10.0.0.102", client.Value)
+	assert.Equal(t, "client", client.Source)
+	assert.Equal(t, "AA-AA-AA-AA-AA-02", client.MAC)
+	assert.Equal(t, "Home", client.Site)
+	assert.NotNil(t, client.Timestamp)
+	assert.NotNil(t, client.AgeSeconds)
+
+	static := records["www.omada.home. CNAME"]
+	assert.Equal(t, "proxy.omada.home.", static.Value)
+	assert.Equal(t, "static", static.Source)
+	assert.Nil(t, static.Timestamp)
+
+	// the controller record shadowed by a static record is not listed
+	shadowed := records["client-001.omada.home. A"]
+	assert.Equal(t, "10.0.0.200", shadowed.Value)
+	assert.Equal(t, "static", shadowed.Source)
+
+	fallback := records["*.omada.home. A"]
+	assert.Equal(t, "10.0.0.1", fallback.Value)
+	assert.Equal(t, "fallback", fallback.Source)
+
+	assert.NotEmpty(t, response.Zones[ptrZone])
+	for _, r := range response.Zones[ptrZone] {
+		assert.Equal(t, "PTR", r.Type)
+	}
+
+	// only GET is allowed
+	rec = httptest.NewRecorder()
+	testOmada.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/records", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminStatus(t *testing.T) {
+
+	testOmada := &Omada{}
+	start := time.Now().Add(-time.Minute)
+	testOmada.setRefreshStatus(start, nil, nil)
+	testOmada.setRefreshStatus(time.Now(), []error{errors.New("clients: timeout")}, errors.New("clients: timeout"))
+
+	rec := httptest.NewRecorder()
+	testOmada.adminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var status refreshStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	assert.Equal(t, "clients: timeout", status.Error)
+	assert.Equal(t, []string{"clients: timeout"}, status.FailedSources)
+	assert.True(t, status.LastSuccess.Equal(start), "last success is kept after a failed refresh")
+	assert.True(t, status.LastAttempt.After(start))
+}
+
+func TestAdminServer(t *testing.T) {
+
+	admin := &adminServer{addr: "127.0.0.1:0", handler: http.NotFoundHandler()}
+	assert.NoError(t, admin.start())
+	assert.NoError(t, admin.start())
+	assert.NoError(t, admin.stop())
+	assert.NoError(t, admin.stop())
+}
+
+func TestAdminRefresh(t *testing.T) {
+
+	testOmada := &Omada{refreshRequests: make(chan struct{}, 1)}
+	handler := testOmada.adminHandler()
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// refresh is disabled without a token
+	assert.Equal(t, http.StatusForbidden, refresh("secret").Code)
+
+	testOmada.config.admin_token = "secret"
+	assert.Equal(t, http.StatusUnauthorized, refresh("").Code)
+	assert.Equal(t, http.StatusUnauthorized, refresh("wrong").Code)
+
+	rec := refresh("secret")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.JSONEq(t, `{"queued": true}`, rec.Body.String())
+
+	// a second request is merged into the pending one
+	rec = refresh("secret")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.JSONEq(t, `{"queued": false}`, rec.Body.String())
+	assert.Len(t, testOmada.refreshRequests, 1)
+}
+
+func TestAdminZones(t *testing.T) {
+
+	zone := file.NewZone("omada.home.", "")
+	addSoaRecord(zone, "omada.home.")
+	testOmada := &Omada{
+		zoneNames: []string{"omada.home."},
+		zones:     map[string]*file.Zone{"omada.home.": zone},
+	}
+	handler := testOmada.adminHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/zones", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `["omada.home."]`, rec.Body.String())
+
+	// zones can be requested with or without the trailing dot
+	for _, path := range []string{"/zones/omada.home", "/zones/omada.home.", "/zones/OMADA.home"} {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+		assert.Equal(t, "text/dns", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), "$ORIGIN omada.home.\n")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/zones/unknown.home", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,241 @@
+package coredns_omada
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	omada "github.com/dougbw/go-omada"
+)
+
+// known clients are requested in pages of this size
+const knownClientsPageSize = 1000
+
+// controllerAPI calls controller endpoints which the omada library does not
+// provide. The library doesn't share its session, so this logs in with its own
+// when it is first used and again after a request failed.
+type controllerAPI struct {
+	baseURL     string
+	httpClient  *http.Client
+	credentials func() (string, string, error)
+
+	mu           sync.Mutex
+	controllerId string
+	token        string
+	siteKeys     map[string]string // site name -> key
+}
+
+// apiResponse is the envelope of every controller api response
+type apiResponse struct {
+	ErrorCode int             `json:"errorCode"`
+	Msg       string          `json:"msg"`
+	Result    json.RawMessage `json:"result"`
+}
+
+// apiPage is the result of a paged controller api request
+type apiPage struct {
+	TotalRows int             `json:"totalRows"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// newControllerAPI returns a client for the controller at baseURL which logs
+// in with the given credentials. Certificate verification follows the omada
+// library's OMADA_DISABLE_HTTPS_VERIFICATION.
+func newControllerAPI(baseURL string, credentials func() (string, string, error)) *controllerAPI {
+	jar, _ := cookiejar.New(nil)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: os.Getenv("OMADA_DISABLE_HTTPS_VERIFICATION") == "true"}
+	return &controllerAPI{
+		baseURL:     baseURL,
+		credentials: credentials,
+		httpClient: &http.Client{
+			Jar:       jar,
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+	}
+}
+
+// session returns the controller id and token of the current session,
+// logging in if there is none
+func (a *controllerAPI) session() (controllerId string, token string, err error) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" {
+		return a.controllerId, a.token, nil
+	}
+
+	username, password, err := a.credentials()
+	if err != nil {
+		return "", "", err
+	}
+	var info struct {
+		OmadacId string `json:"omadacId"`
+	}
+	if err := a.do(http.MethodGet, "/api/info", "", nil, &info); err != nil {
+		return "", "", fmt.Errorf("error getting controller info: %w", err)
+	}
+	credentials := map[string]string{"username": username, "password": password}
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err := a.do(http.MethodPost, fmt.Sprintf("/%s/api/v2/login", info.OmadacId), "", credentials, &login); err != nil {
+		return "", "", fmt.Errorf("error logging in: %w", err)
+	}
+
+	a.controllerId = info.OmadacId
+	a.token = login.Token
+	return a.controllerId, a.token, nil
+}
+
+// get sends a request with the session to a path below the controller's api
+// and decodes the result. A failed request drops the session, so the next
+// request logs in again.
+func (a *controllerAPI) get(path string, query url.Values, result any) error {
+
+	controllerId, token, err := a.session()
+	if err != nil {
+		return err
+	}
+	path = fmt.Sprintf("/%s/api/v2/%s", controllerId, path)
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	if err := a.do(http.MethodGet, path, token, nil, result); err != nil {
+		a.mu.Lock()
+		if a.token == token {
+			a.token = ""
+		}
+		a.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// getSites returns the key of every site the user has access to by name
+func (a *controllerAPI) getSites() (map[string]string, error) {
+
+	var user struct {
+		Privilege struct {
+			Sites []struct {
+				Name string `json:"name"`
+				Key  string `json:"key"`
+			} `json:"sites"`
+		} `json:"privilege"`
+	}
+	if err := a.get("users/current", nil, &user); err != nil {
+		return nil, fmt.Errorf("error getting sites: %w", err)
+	}
+	sites := make(map[string]string)
+	for _, site := range user.Privilege.Sites {
+		sites[site.Name] = site.Key
+	}
+
+	a.mu.Lock()
+	a.siteKeys = sites
+	a.mu.Unlock()
+	return sites, nil
+}
+
+// siteKey returns the key of a site, refreshing the site list if the site
+// isn't known yet
+func (a *controllerAPI) siteKey(site string) (string, error) {
+
+	a.mu.Lock()
+	key, ok := a.siteKeys[site]
+	a.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	sites, err := a.getSites()
+	if err != nil {
+		return "", err
+	}
+	if key, ok := sites[site]; ok {
+		return key, nil
+	}
+	return "", fmt.Errorf("site not found: %s", site)
+}
+
+// getKnownClients returns every client a site has seen, including clients
+// which are currently offline
+func (a *controllerAPI) getKnownClients(site string) ([]omada.Client, error) {
+
+	key, err := a.siteKey(site)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []omada.Client
+	for page := 1; ; page++ {
+		query := url.Values{}
+		query.Set("currentPage", strconv.Itoa(page))
+		query.Set("currentPageSize", strconv.Itoa(knownClientsPageSize))
+
+		var result apiPage
+		if err := a.get(fmt.Sprintf("sites/%s/insight/clients", key), query, &result); err != nil {
+			return nil, err
+		}
+		var data []omada.Client
+		if err := json.Unmarshal(result.Data, &data); err != nil {
+			return nil, fmt.Errorf("error decoding known clients: %w", err)
+		}
+		clients = append(clients, data...)
+		if len(data) == 0 || len(clients) >= result.TotalRows {
+			return clients, nil
+		}
+	}
+}
+
+// do sends a request to the controller and decodes the result of the response
+// envelope into result
+func (a *controllerAPI) do(method string, path string, token string, body any, result any) error {
+
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, a.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Csrf-Token", token)
+	}
+
+	res, err := a.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", req.URL.Path, res.Status)
+	}
+
+	var response apiResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return fmt.Errorf("error decoding response from %s: %w", req.URL.Path, err)
+	}
+	if response.ErrorCode != 0 {
+		return fmt.Errorf("controller error %d from %s: %s", response.ErrorCode, req.URL.Path, response.Msg)
+	}
+	return json.Unmarshal(response.Result, result)
+}
@@ -0,0 +1,125 @@
+package coredns_omada
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCredentials returns the credentials of the mock controller
+func testCredentials() (string, string, error) {
+	return "test", "test", nil
+}
+
+func TestControllerAPIKnownClients(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	// the first request logs in
+	api := newControllerAPI(testServer.URL, testCredentials)
+	clients, err := api.getKnownClients("Home")
+	assert.NoError(t, err)
+	if assert.Len(t, clients, 2) {
+		assert.Equal(t, "Old Laptop", clients[1].Name)
+		assert.Equal(t, "10.0.0.150", clients[1].Ip)
+		assert.Equal(t, int64(1705000000000), clients[1].LastSeen)
+	}
+
+	_, err = api.getKnownClients("Branch")
+	assert.ErrorContains(t, err, "site not found")
+
+	// failing to read the credentials fails the request
+	api = newControllerAPI(testServer.URL, func() (string, string, error) { return "", "", errors.New("no password") })
+	_, err = api.getKnownClients("Home")
+	assert.ErrorContains(t, err, "no password")
+}
+
+func TestControllerAPIKnownClientsPages(t *testing.T) {
+
+	var tokens []string
+	var logins atomic.Int32
+	var expired atomic.Bool
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/info":
+			fmt.Fprint(w, `{"errorCode": 0, "result": {"omadacId": "abc"}}`)
+		case "/abc/api/v2/login":
+			logins.Add(1)
+			fmt.Fprint(w, `{"errorCode": 0, "result": {"token": "1234"}}`)
+		case "/abc/api/v2/users/current":
+			fmt.Fprint(w, `{"errorCode": 0, "result": {"privilege": {"sites": [{"name": "Home", "key": "Default"}]}}}`)
+		case "/abc/api/v2/sites/Default/insight/clients":
+			if expired.Swap(false) {
+				fmt.Fprint(w, `{"errorCode": -1200, "msg": "session expired"}`)
+				return
+			}
+			tokens = append(tokens, r.Header.Get("Csrf-Token"))
+			page := r.URL.Query().Get("currentPage")
+			fmt.Fprintf(w, `{"errorCode": 0, "result": {"totalRows": 3, "data": [{"mac": "AA-AA-AA-AA-AA-0%s"}%s]}}`, page, map[string]string{"1": `, {"mac": "AA-AA-AA-AA-AA-00"}`}[page])
+		default:
+			fmt.Fprint(w, `{"errorCode": -1, "msg": "not found"}`)
+		}
+	}))
+	defer testServer.Close()
+
+	api := newControllerAPI(testServer.URL, testCredentials)
+	clients, err := api.getKnownClients("Home")
+	assert.NoError(t, err)
+	assert.Len(t, clients, 3)
+	assert.Equal(t, []string{"1234", "1234"}, tokens)
+	assert.Equal(t, int32(1), logins.Load())
+
+	// a failed request logs in again on the next one
+	expired.Store(true)
+	_, err = api.getKnownClients("Home")
+	assert.ErrorContains(t, err, "controller error -1200")
+	_, err = api.getKnownClients("Home")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), logins.Load())
+}
+
+func TestUpdateWithFailingKnownClients(t *testing.T) {
+
+	testServer := setupFailingTestServer(func(path string) bool {
+		return strings.HasSuffix(path, "/insight/clients")
+	})
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithFailingKnownClients/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_known_clients = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+
+	// only the known clients source fails, startup and active clients are not affected
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithFailingKnownClients/controllerInit': %v", err)
+	}
+	assert.Len(t, testOmada.status.FailedSources, 1)
+	assert.Contains(t, testOmada.status.FailedSources[0], "known clients")
+	executeTestCases(t, testOmada, []testCases{
+		{
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+	})
+}
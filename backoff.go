@@ -0,0 +1,105 @@
+package coredns_omada
+
+import (
+	"context"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// backoff computes exponentially increasing retry delays with optional jitter
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	multiplier float64
+	jitter     float64
+	attempt    int
+}
+
+func newBackoff(c config) *backoff {
+	return &backoff{
+		initial:    c.backoff_initial,
+		max:        c.backoff_max,
+		multiplier: c.backoff_multiplier,
+		jitter:     c.backoff_jitter,
+	}
+}
+
+// next returns the delay to wait before the next attempt and advances the backoff
+func (b *backoff) next() time.Duration {
+	delay := float64(b.initial) * math.Pow(b.multiplier, float64(b.attempt))
+	if delay >= float64(b.max) {
+		delay = float64(b.max)
+	} else {
+		b.attempt++
+	}
+
+	// spread retries over +/- jitter of the delay, without exceeding max
+	if b.jitter > 0 {
+		delay += delay * b.jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(min(delay, float64(b.max)))
+}
+
+// sleepContext waits for the delay and returns early with the context's error
+// when it is cancelled, so a reloaded or stopped instance stops retrying
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reset returns the backoff to the initial delay after a successful attempt
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+// controllerHealth tracks consecutive controller failures per operation so that
+// state transitions are logged once instead of on every retry
+type controllerHealth struct {
+	mu       sync.Mutex
+	failures map[string]int
+	notify   func(op string, err error) // called when an operation starts failing (err set) or recovers
+}
+
+// failure records a failed operation and returns the number of consecutive failures
+func (h *controllerHealth) failure(op string, err error) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.failures == nil {
+		h.failures = make(map[string]int)
+	}
+	h.failures[op]++
+	n := h.failures[op]
+	if n == 1 {
+		log.Errorf("%s: controller degraded: %v", op, err)
+		if h.notify != nil {
+			h.notify(op, err)
+		}
+	} else {
+		log.Debugf("%s: still failing after %d attempts: %v", op, n, err)
+	}
+	return n
+}
+
+// success records a successful operation, logging recovery if it was failing
+func (h *controllerHealth) success(op string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n := h.failures[op]; n > 0 {
+		log.Infof("%s: controller recovered after %d failed attempts", op, n)
+		delete(h.failures, op)
+		if h.notify != nil {
+			h.notify(op, nil)
+		}
+	}
+}
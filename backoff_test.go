@@ -0,0 +1,99 @@
+package coredns_omada
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+
+	b := &backoff{
+		initial:    time.Second,
+		max:        10 * time.Second,
+		multiplier: 2,
+	}
+
+	expected := []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for _, want := range expected {
+		assert.Equal(t, want, b.next())
+	}
+
+	b.reset()
+	assert.Equal(t, time.Second, b.next())
+}
+
+func TestBackoffJitter(t *testing.T) {
+
+	b := &backoff{
+		initial:    10 * time.Second,
+		max:        10 * time.Second,
+		multiplier: 2,
+		jitter:     0.5,
+	}
+
+	for i := 0; i < 100; i++ {
+		delay := b.next()
+		assert.GreaterOrEqual(t, delay, 5*time.Second)
+		assert.LessOrEqual(t, delay, 10*time.Second, "jitter never exceeds max")
+	}
+
+	b = &backoff{
+		initial:    4 * time.Second,
+		max:        10 * time.Second,
+		multiplier: 1,
+		jitter:     0.5,
+	}
+	for i := 0; i < 100; i++ {
+		delay := b.next()
+		assert.GreaterOrEqual(t, delay, 2*time.Second)
+		assert.LessOrEqual(t, delay, 6*time.Second)
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+
+	assert.NoError(t, sleepContext(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	assert.ErrorIs(t, sleepContext(ctx, time.Hour), context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestControllerHealth(t *testing.T) {
+
+	var h controllerHealth
+	err := errors.New("connection refused")
+
+	assert.Equal(t, 1, h.failure("refresh", err))
+	assert.Equal(t, 2, h.failure("refresh", err))
+	assert.Equal(t, 1, h.failure("login", err))
+
+	h.success("refresh")
+	assert.Equal(t, 1, h.failure("refresh", err))
+
+	// only transitions are notified
+	var notified []string
+	h.notify = func(op string, err error) {
+		notified = append(notified, fmt.Sprintf("%s %v", op, err))
+	}
+	h.success("refresh")
+	h.failure("refresh", err)
+	h.failure("refresh", err)
+	h.success("refresh")
+	h.success("refresh")
+	assert.Equal(t, []string{"refresh <nil>", "refresh connection refused", "refresh <nil>"}, notified)
+}
@@ -0,0 +1,152 @@
+package coredns_omada
+
+import (
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// recordChange is a name which was added, removed or now points at a
+// different address between two consecutive builds of the zones
+type recordChange struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // added, removed or changed
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Value    string    `json:"value,omitempty"`
+	OldValue string    `json:"old_value,omitempty"`
+	Source   string    `json:"source"`
+	MAC      string    `json:"mac,omitempty"`
+	OldMAC   string    `json:"old_mac,omitempty"`
+	Site     string    `json:"site,omitempty"`
+}
+
+// addressSet is the addresses of a name and where the name came from
+type addressSet struct {
+	values []string
+	recordInfo
+}
+
+// addressSets groups the A and AAAA records of the entries by name and type.
+// Dynamic and static records replace controller records like they do when the
+// zones are built.
+func addressSets(entries []recordEntry) map[string]*addressSet {
+
+	sets := make(map[string]*addressSet)
+	for _, e := range entries {
+		hdr := e.rr.Header()
+		if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeAAAA {
+			continue
+		}
+		key := strings.ToLower(hdr.Name) + " " + dns.TypeToString[hdr.Rrtype]
+		value := addressOf(e.rr).String()
+		set, ok := sets[key]
+		switch {
+		case !ok || sourcePrecedence(e.source) > sourcePrecedence(set.source):
+			sets[key] = &addressSet{values: []string{value}, recordInfo: e.recordInfo}
+		case sourcePrecedence(e.source) == sourcePrecedence(set.source):
+			set.values = append(set.values, value)
+		}
+	}
+	for _, set := range sets {
+		slices.Sort(set.values)
+	}
+	return sets
+}
+
+// sourcePrecedence orders record sources by which one is served for a name
+func sourcePrecedence(source string) int {
+	switch source {
+	case "static":
+		return 2
+	case "dynamic":
+		return 1
+	}
+	return 0
+}
+
+// diffRecords returns the names which were added, removed or changed address
+// between two sets of entries, sorted by name
+func diffRecords(previous []recordEntry, current []recordEntry, now time.Time) []recordChange {
+
+	before := addressSets(previous)
+	after := addressSets(current)
+
+	var changes []recordChange
+	for key, set := range after {
+		name, rrtype, _ := strings.Cut(key, " ")
+		change := recordChange{Time: now, Name: name, Type: rrtype, Value: strings.Join(set.values, ","),
+			Source: set.source, MAC: set.mac, Site: set.site}
+		old, ok := before[key]
+		switch {
+		case !ok:
+			change.Action = "added"
+		case !slices.Equal(old.values, set.values):
+			change.Action = "changed"
+			change.OldValue = strings.Join(old.values, ",")
+			if old.mac != set.mac {
+				change.OldMAC = old.mac
+			}
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	for key, set := range before {
+		if _, ok := after[key]; ok {
+			continue
+		}
+		name, rrtype, _ := strings.Cut(key, " ")
+		changes = append(changes, recordChange{Time: now, Action: "removed", Name: name, Type: rrtype,
+			OldValue: strings.Join(set.values, ","), Source: set.source, MAC: set.mac, Site: set.site})
+	}
+	slices.SortFunc(changes, func(a, b recordChange) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Type, b.Type)
+	})
+	return changes
+}
+
+// publishChanges logs each change, appends it to the change_log and sends it
+// to the webhooks
+func (o *Omada) publishChanges(changes []recordChange) {
+
+	if len(changes) == 0 {
+		return
+	}
+	for _, c := range changes {
+		log.Infof("change: action=%s name=%s type=%s value=%q old_value=%q source=%q mac=%q old_mac=%q site=%q",
+			c.Action, c.Name, c.Type, c.Value, c.OldValue, c.Source, c.MAC, c.OldMAC, c.Site)
+	}
+	if o.config.change_log != "" {
+		if err := appendChanges(o.config.change_log, changes); err != nil {
+			log.Warningf("change: failed to write change log %s: %v", o.config.change_log, err)
+		}
+	}
+	if o.webhook != nil {
+		o.webhook.send(webhookEvent{Time: changes[0].Time, Event: "records_changed", Changes: changes})
+	}
+}
+
+// appendChanges appends the changes to a file as JSON lines
+func appendChanges(path string, changes []recordChange) error {
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, c := range changes {
+		if err := enc.Encode(c); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
@@ -0,0 +1,97 @@
+package coredns_omada
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func testEntry(t *testing.T, record string, info recordInfo) recordEntry {
+	return recordEntry{zone: "omada.home.", rr: mustParseStaticRecord(t, record), timestamp: time.Now(), recordInfo: info}
+}
+
+func TestDiffRecords(t *testing.T) {
+
+	laptop := recordInfo{source: "client", mac: "AA-AA-AA-AA-AA-01", site: "Home"}
+	phone := recordInfo{source: "client", mac: "AA-AA-AA-AA-AA-02", site: "Home"}
+	now := time.Now()
+
+	previous := []recordEntry{
+		testEntry(t, "laptop.omada.home. 60 IN A 10.0.0.101", laptop),
+		testEntry(t, "phone.omada.home. 60 IN A 10.0.0.102", phone),
+		testEntry(t, "printer.omada.home. 60 IN A 10.0.0.103", recordInfo{source: "device", mac: "AA-AA-AA-AA-AA-03"}),
+		testEntry(t, "nas.omada.home. 60 IN A 10.0.0.104", recordInfo{source: "reservation", mac: "AA-AA-AA-AA-AA-04"}),
+		testEntry(t, "101.0.0.10.in-addr.arpa. 60 IN PTR laptop.omada.home.", laptop),
+	}
+	current := []recordEntry{
+		// unchanged
+		testEntry(t, "laptop.omada.home. 60 IN A 10.0.0.101", laptop),
+		// new address and mac
+		testEntry(t, "phone.omada.home. 60 IN A 10.0.0.110", recordInfo{source: "client", mac: "AA-AA-AA-AA-AA-10", site: "Home"}),
+		// a static record replaces the reservation
+		testEntry(t, "nas.omada.home. 60 IN A 10.0.0.104", recordInfo{source: "reservation", mac: "AA-AA-AA-AA-AA-04"}),
+		testEntry(t, "nas.omada.home. 300 IN A 10.0.0.200", recordInfo{source: "static"}),
+		// new name
+		testEntry(t, "tv.omada.home. 60 IN A 10.0.0.105", recordInfo{source: "dynamic"}),
+		// PTR records are not compared
+		testEntry(t, "110.0.0.10.in-addr.arpa. 60 IN PTR phone.omada.home.", phone),
+	}
+
+	changes := diffRecords(previous, current, now)
+	assert.Equal(t, []recordChange{
+		{Time: now, Action: "changed", Name: "nas.omada.home.", Type: "A", Value: "10.0.0.200", OldValue: "10.0.0.104", Source: "static", OldMAC: "AA-AA-AA-AA-AA-04"},
+		{Time: now, Action: "changed", Name: "phone.omada.home.", Type: "A", Value: "10.0.0.110", OldValue: "10.0.0.102", Source: "client", MAC: "AA-AA-AA-AA-AA-10", OldMAC: "AA-AA-AA-AA-AA-02", Site: "Home"},
+		{Time: now, Action: "removed", Name: "printer.omada.home.", Type: "A", OldValue: "10.0.0.103", Source: "device", MAC: "AA-AA-AA-AA-AA-03"},
+		{Time: now, Action: "added", Name: "tv.omada.home.", Type: "A", Value: "10.0.0.105", Source: "dynamic"},
+	}, changes)
+
+	assert.Empty(t, diffRecords(current, current, now))
+}
+
+func TestPublishChanges(t *testing.T) {
+
+	o := testDynamicOmada()
+	o.config.update_lifetime = time.Hour
+	o.config.stale_record_duration = time.Hour
+	o.config.change_log = filepath.Join(t.TempDir(), "changes.jsonl")
+
+	o.uMu.Lock()
+	o.buildZones(o.records)
+	o.uMu.Unlock()
+
+	// the first build is not a change
+	_, err := os.Stat(o.config.change_log)
+	assert.True(t, os.IsNotExist(err))
+
+	vm := &dns.A{Hdr: dns.RR_Header{Name: "vm1.omada.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 120}}
+	vm.A = []byte{192, 168, 0, 150}
+	o.uMu.Lock()
+	assert.Equal(t, dns.RcodeSuccess, o.applyUpdate("omada.test.", []dns.RR{vm}))
+	o.buildZones(o.records)
+	o.uMu.Unlock()
+
+	f, err := os.Open(o.config.change_log)
+	if err != nil {
+		t.Fatalf("change log was not written: %v", err)
+	}
+	defer f.Close()
+
+	var changes []recordChange
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var c recordChange
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &c))
+		changes = append(changes, c)
+	}
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "added", changes[0].Action)
+	assert.Equal(t, "vm1.omada.test.", changes[0].Name)
+	assert.Equal(t, "192.168.0.150", changes[0].Value)
+	assert.Equal(t, "dynamic", changes[0].Source)
+}
@@ -1,40 +1,110 @@
 package coredns_omada
 
 import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/go-playground/validator/v10"
+	"github.com/miekg/dns"
+)
+
+const (
+	minRefresh      = 10 * time.Second // shortest allowed zone refresh interval
+	minLoginRefresh = time.Minute      // shortest allowed login refresh interval
+	minSiteRefresh  = time.Minute      // shortest allowed site list refresh interval
 )
 
 type config struct {
-	Controller_url string `validate:"required,url"`
-	Site           string `validate:"required"`
-	Username       string `validate:"required"`
-	Password       string `validate:"required"`
-
-	refresh_minutes           int           // update dns zones every x minutes
-	refresh_login_hours       int           // login and get a new session token every x hours
-	resolve_clients           bool          // resolve 'client' addresses
-	resolve_devices           bool          // resolve 'device' addresses
-	resolve_dhcp_reservations bool          // resolve static 'dhcp reservations'
-	stale_record_duration     time.Duration // duration to keep serving stale records for clients no longer present in the controller)
-	ignore_startup_errors     bool          // ignore any errors during the initial zone refresh
-	fallback                  string        // fallback target when original lookup fails (FQDN, hostname, or IP address)
+	Controller_url string   `validate:"required,url"`
+	Site           []string `validate:"required"`
+	Username       string   `validate:"required"`
+	Password       string   `validate:"required"`
+
+	username_file             string                    // file the username is read from on every login
+	password_file             string                    // file the password is read from on every login
+	tls                       tlsOptions                // how the controller's certificate is verified
+	tls_config                *tls.Config               // tls configuration built from the tls options (nil when none are set)
+	exclude_site              []string                  // sites matching any of these values are never used
+	site_match                string                    // how site and exclude_site values are matched ('regex' or 'exact')
+	site_filter               siteFilter                // compiled site and exclude_site values
+	refresh                   time.Duration             // update dns zones at this interval
+	login_refresh             time.Duration             // login and get a new session token at this interval
+	site_refresh              time.Duration             // refresh the controller site list at this interval (0 disables)
+	resolve_clients           bool                      // resolve 'client' addresses
+	clients_active_only       bool                      // only resolve clients the controller reports as active
+	clients_use_last_seen     bool                      // use the controller's lastSeen as the client record timestamp
+	resolve_known_clients     bool                      // resolve known (historical) clients including offline clients
+	known_clients_ttl         time.Duration             // ttl of records for known clients
+	known_clients_retention   time.Duration             // how long known clients are resolved after they were last seen
+	resolve_devices           bool                      // resolve 'device' addresses
+	resolve_dhcp_reservations bool                      // resolve static 'dhcp reservations'
+	client_filter             recordFilter              // include/exclude rules for clients
+	device_filter             recordFilter              // include/exclude rules for devices
+	reservation_filter        recordFilter              // include/exclude rules for dhcp reservations
+	stale_record_duration     time.Duration             // duration to keep serving stale records for clients no longer present in the controller)
+	ignore_startup_errors     bool                      // ignore any errors during the initial zone refresh
+	fallback                  fallbackConfig            // fallback when original lookup fails (FQDNs, hostnames, IP addresses or a CNAME)
+	fallback_resolver         string                    // upstream resolver (host:port) for fqdn fallback targets outside of the managed zones
+	fallback_mode             string                    // which names the fallback answers: all, single_label or no_host_subdomains
+	fallback_exclude          fallbackExclusions        // names which get NXDOMAIN instead of the fallback
+	zone_fallbacks            map[string]fallbackConfig // per zone fallbacks replacing the global fallback
+	admin_listen              string                    // listen address of the admin http api (disabled when empty)
+	admin_token               string                    // bearer token required to force a refresh through the admin api
+	refresh_debounce          time.Duration             // minimum time between a forced refresh and the previous refresh
+	export_zone_dir           string                    // directory every zone is written to as a zone file after it is built
+	hosts_exports             []hostsExport             // files the address and ptr records are written to after the zones are built
+	change_log                string                    // file record changes are appended to as json lines
+	webhooks                  []string                  // urls record changes and controller health events are posted to
+	webhook_secret            string                    // secret the webhook bodies are signed with (hmac-sha256)
+	webhook_retries           int                       // number of times a failed webhook delivery is retried
+	structured_log            []string                  // structured events to log: refresh and/or query
+	structured_log_format     string                    // format of the structured events: logfmt or json
+	site_workers              int                       // number of sites fetched from the controller concurrently
+	records                   []dns.RR                  // static records merged into the generated zones
+	zonefiles                 []zoneFile                // zone files whose records are merged into the generated zones
+	update_keys               map[string]string         // tsig keys (name -> secret) allowed to send dynamic updates
+	update_lifetime           time.Duration             // how long records added by dynamic updates are kept
+	update_override           bool                      // allow dynamic updates to replace records from the controller
+	backoff_initial           time.Duration             // delay before the first retry after a controller failure
+	backoff_max               time.Duration             // upper bound for the retry delay
+	backoff_multiplier        float64                   // factor the retry delay grows by after each consecutive failure
+	backoff_jitter            float64                   // random +/- fraction applied to each retry delay
 }
 
 func parse(c *caddy.Controller) (config config, err error) {
 
 	// defaults
-	config.refresh_minutes = 1
-	config.refresh_login_hours = 24
+	config.site_match = "regex"
+	config.fallback_mode = "all"
+	config.refresh = time.Minute
+	config.login_refresh = 24 * time.Hour
+	config.site_refresh = time.Hour
 	config.resolve_clients = true
+	config.known_clients_ttl = time.Minute
+	config.known_clients_retention = 7 * 24 * time.Hour
 	config.resolve_devices = true
 	config.resolve_dhcp_reservations = true
 	config.stale_record_duration, _ = time.ParseDuration("10m")
 	config.ignore_startup_errors = false
+	config.site_workers = 4
+	config.refresh_debounce = 30 * time.Second
+	config.webhook_retries = 3
+	config.structured_log_format = "logfmt"
+	config.update_lifetime = 24 * time.Hour
+	config.backoff_initial = 15 * time.Second
+	config.backoff_max = 10 * time.Minute
+	config.backoff_multiplier = 2
+	config.backoff_jitter = 0.2
 
 	for c.Next() {
 
@@ -48,40 +118,171 @@ func parse(c *caddy.Controller) (config config, err error) {
 				config.Controller_url = c.Val()
 
 			case "site":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return config, c.ArgErr()
+				}
+				config.Site = append(config.Site, args...)
+
+			case "exclude_site":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return config, c.ArgErr()
+				}
+				config.exclude_site = append(config.exclude_site, args...)
+
+			case "site_match":
 				if !c.NextArg() {
 					return config, c.ArgErr()
 				}
-				config.Site = c.Val()
+				switch c.Val() {
+				case "regex", "exact":
+					config.site_match = c.Val()
+				default:
+					return config, c.Errf("site_match must be 'regex' or 'exact': %q", c.Val())
+				}
 
 			case "username":
 				if !c.NextArg() {
 					return config, c.ArgErr()
 				}
+				if config.username_file != "" {
+					return config, c.Err("username and username_file are mutually exclusive")
+				}
 				config.Username = c.Val()
 
 			case "password":
 				if !c.NextArg() {
 					return config, c.ArgErr()
 				}
+				if config.password_file != "" {
+					return config, c.Err("password and password_file are mutually exclusive")
+				}
 				config.Password = c.Val()
 
+			case "username_file":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				if config.Username != "" {
+					return config, c.Err("username and username_file are mutually exclusive")
+				}
+				// read once to fail early, the file is read again on every login
+				config.Username, err = readSecretFile(c.Val())
+				if err != nil {
+					return config, c.Errf("username_file: %v", err)
+				}
+				config.username_file = c.Val()
+
+			case "password_file":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				if config.Password != "" {
+					return config, c.Err("password and password_file are mutually exclusive")
+				}
+				config.Password, err = readSecretFile(c.Val())
+				if err != nil {
+					return config, c.Errf("password_file: %v", err)
+				}
+				config.password_file = c.Val()
+
+			case "tls_ca_file":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.tls.ca_file = c.Val()
+
+			case "tls_pin_sha256":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return config, c.ArgErr()
+				}
+				for _, arg := range args {
+					pin, err := parsePin(arg)
+					if err != nil {
+						return config, c.Errf("tls_pin_sha256: %v", err)
+					}
+					config.tls.pins = append(config.tls.pins, pin)
+				}
+
+			case "tls_server_name":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.tls.server_name = c.Val()
+
+			case "insecure_skip_verify":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.tls.insecure_skip_verify, err = strconv.ParseBool(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+
+			case "refresh":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.refresh, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.Errf("invalid refresh duration %q: %v", c.Val(), err)
+				}
+				if config.refresh < minRefresh {
+					return config, c.Errf("refresh must be at least %s: %q", minRefresh, c.Val())
+				}
+
+			case "login_refresh":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.login_refresh, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.Errf("invalid login_refresh duration %q: %v", c.Val(), err)
+				}
+				if config.login_refresh < minLoginRefresh {
+					return config, c.Errf("login_refresh must be at least %s: %q", minLoginRefresh, c.Val())
+				}
+
+			case "site_refresh":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.site_refresh, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.Errf("invalid site_refresh duration %q: %v", c.Val(), err)
+				}
+				if config.site_refresh != 0 && config.site_refresh < minSiteRefresh {
+					return config, c.Errf("site_refresh must be 0 or at least %s: %q", minSiteRefresh, c.Val())
+				}
+
+			// refresh_minutes and refresh_login_hours are kept for existing Corefiles
 			case "refresh_minutes":
 				if !c.NextArg() {
 					return config, c.ArgErr()
 				}
-				config.refresh_minutes, err = strconv.Atoi(c.Val())
+				minutes, err := strconv.Atoi(c.Val())
 				if err != nil {
 					return config, c.ArgErr()
 				}
+				if minutes < 1 {
+					return config, c.Errf("refresh_minutes must be at least 1: %q", c.Val())
+				}
+				config.refresh = time.Duration(minutes) * time.Minute
 
 			case "refresh_login_hours":
 				if !c.NextArg() {
 					return config, c.ArgErr()
 				}
-				config.refresh_login_hours, err = strconv.Atoi(c.Val())
+				hours, err := strconv.Atoi(c.Val())
 				if err != nil {
 					return config, c.ArgErr()
 				}
+				if hours < 1 {
+					return config, c.Errf("refresh_login_hours must be at least 1: %q", c.Val())
+				}
+				config.login_refresh = time.Duration(hours) * time.Hour
 
 			case "resolve_clients":
 				if !c.NextArg() {
@@ -92,6 +293,57 @@ func parse(c *caddy.Controller) (config config, err error) {
 					return config, c.ArgErr()
 				}
 
+			case "clients_active_only":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.clients_active_only, err = strconv.ParseBool(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+
+			case "clients_use_last_seen":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.clients_use_last_seen, err = strconv.ParseBool(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+
+			case "resolve_known_clients":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.resolve_known_clients, err = strconv.ParseBool(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+
+			case "known_clients_ttl":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.known_clients_ttl, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+				if config.known_clients_ttl < time.Second {
+					return config, c.Errf("known_clients_ttl must be at least 1s: %q", c.Val())
+				}
+
+			case "known_clients_retention":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.known_clients_retention, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+				if config.known_clients_retention <= 0 {
+					return config, c.Errf("known_clients_retention must be greater than zero: %q", c.Val())
+				}
+
 			case "resolve_devices":
 				if !c.NextArg() {
 					return config, c.ArgErr()
@@ -110,6 +362,21 @@ func parse(c *caddy.Controller) (config config, err error) {
 					return config, c.ArgErr()
 				}
 
+			case "client_filter":
+				if err := config.client_filter.addRule(c.RemainingArgs(), clientFilterFields); err != nil {
+					return config, c.Errf("client_filter: %v", err)
+				}
+
+			case "device_filter":
+				if err := config.device_filter.addRule(c.RemainingArgs(), deviceFilterFields); err != nil {
+					return config, c.Errf("device_filter: %v", err)
+				}
+
+			case "dhcp_reservation_filter":
+				if err := config.reservation_filter.addRule(c.RemainingArgs(), reservationFilterFields); err != nil {
+					return config, c.Errf("dhcp_reservation_filter: %v", err)
+				}
+
 			case "stale_record_duration":
 				if !c.NextArg() {
 					return config, c.ArgErr()
@@ -129,32 +396,322 @@ func parse(c *caddy.Controller) (config config, err error) {
 				}
 
 			case "fallback":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return config, c.ArgErr()
+				}
+				targets, err := parseFallbackTargets(args)
+				if err != nil {
+					return config, c.Errf("%v", err)
+				}
+				config.fallback = fallbackConfig{targets: targets}
+
+			case "fallback_cname":
 				if !c.NextArg() {
 					return config, c.ArgErr()
 				}
-				fallbackValue := c.Val()
+				if err := validateFallbackTarget(c.Val()); err != nil || net.ParseIP(c.Val()) != nil {
+					return config, c.Errf("fallback_cname must be a hostname or FQDN: %q", c.Val())
+				}
+				config.fallback = fallbackConfig{cname: c.Val()}
+
+			case "zone_fallback":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return config, c.ArgErr()
+				}
+				targets, err := parseFallbackTargets(args[1:])
+				if err != nil {
+					return config, c.Errf("%v", err)
+				}
+				if config.zone_fallbacks == nil {
+					config.zone_fallbacks = make(map[string]fallbackConfig)
+				}
+				config.zone_fallbacks[strings.ToLower(dns.Fqdn(args[0]))] = fallbackConfig{targets: targets}
 
-				// Basic validation: check reasonable length
-				if len(fallbackValue) > 253 {
-					return config, c.Errf("fallback too long (max 253 characters): %q", fallbackValue)
+			case "zone_fallback_cname":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return config, c.ArgErr()
+				}
+				if err := validateFallbackTarget(args[1]); err != nil || net.ParseIP(args[1]) != nil {
+					return config, c.Errf("zone_fallback_cname must be a hostname or FQDN: %q", args[1])
 				}
+				if config.zone_fallbacks == nil {
+					config.zone_fallbacks = make(map[string]fallbackConfig)
+				}
+				config.zone_fallbacks[strings.ToLower(dns.Fqdn(args[0]))] = fallbackConfig{cname: args[1]}
 
-				// Validate characters for domain/hostname/IPv4 (if not empty)
-				if len(fallbackValue) > 0 {
-					// Check valid characters and no consecutive dots
-					validChars := regexp.MustCompile(`^[a-zA-Z0-9.-]+$`)
-					noConsecutiveDots := regexp.MustCompile(`\.\.`)
-					// Check each label doesn't start/end with hyphen
-					invalidLabels := regexp.MustCompile(`(^|\.)-|-(\.|$)`)
+			case "fallback_resolver":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				resolver := c.Val()
+				if _, _, err := net.SplitHostPort(resolver); err != nil {
+					resolver = net.JoinHostPort(resolver, "53")
+				}
+				if host, _, _ := net.SplitHostPort(resolver); host == "" {
+					return config, c.Errf("invalid fallback_resolver: %q", c.Val())
+				}
+				config.fallback_resolver = resolver
+
+			case "fallback_mode":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				switch c.Val() {
+				case "all", "single_label", "no_host_subdomains":
+					config.fallback_mode = c.Val()
+				default:
+					return config, c.Errf("fallback_mode must be 'all', 'single_label' or 'no_host_subdomains': %q", c.Val())
+				}
 
-					if !validChars.MatchString(fallbackValue) ||
-						noConsecutiveDots.MatchString(fallbackValue) ||
-						invalidLabels.MatchString(fallbackValue) {
-						return config, c.Errf("fallback contains invalid characters: %q", fallbackValue)
+			case "fallback_exclude":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return config, c.ArgErr()
+				}
+				for _, label := range args {
+					config.fallback_exclude.labels = append(config.fallback_exclude.labels, strings.TrimSuffix(label, "."))
+				}
+
+			case "fallback_exclude_regex":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return config, c.ArgErr()
+				}
+				for _, pattern := range args {
+					re, err := regexp.Compile(pattern)
+					if err != nil {
+						return config, c.Errf("invalid fallback_exclude_regex %q: %v", pattern, err)
 					}
+					config.fallback_exclude.patterns = append(config.fallback_exclude.patterns, re)
+				}
+
+			case "admin_listen":
+				if !c.NextArg() {
+					return config, c.ArgErr()
 				}
+				if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+					return config, c.Errf("invalid admin_listen address %q: %v", c.Val(), err)
+				}
+				config.admin_listen = c.Val()
 
-				config.fallback = fallbackValue
+			case "admin_token":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.admin_token = c.Val()
+
+			case "refresh_debounce":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.refresh_debounce, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.Errf("invalid refresh_debounce: %v", err)
+				}
+				if config.refresh_debounce < minRefresh {
+					return config, c.Errf("refresh_debounce must be at least %s: %s", minRefresh, c.Val())
+				}
+
+			case "export_zone_dir":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				info, err := os.Stat(c.Val())
+				if err != nil {
+					return config, c.Errf("export_zone_dir: %v", err)
+				}
+				if !info.IsDir() {
+					return config, c.Errf("export_zone_dir is not a directory: %q", c.Val())
+				}
+				config.export_zone_dir = c.Val()
+
+			case "export_hosts":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return config, c.ArgErr()
+				}
+				if !slices.Contains(hostsFormats, args[0]) {
+					return config, c.Errf("export_hosts format must be one of %s: %q", strings.Join(hostsFormats, ", "), args[0])
+				}
+				if info, err := os.Stat(filepath.Dir(args[1])); err != nil || !info.IsDir() {
+					return config, c.Errf("export_hosts directory does not exist: %q", args[1])
+				}
+				config.hosts_exports = append(config.hosts_exports, hostsExport{format: args[0], path: args[1]})
+
+			case "change_log":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				if info, err := os.Stat(filepath.Dir(c.Val())); err != nil || !info.IsDir() {
+					return config, c.Errf("change_log directory does not exist: %q", c.Val())
+				}
+				config.change_log = c.Val()
+
+			case "webhook":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				u, err := url.Parse(c.Val())
+				if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+					return config, c.Errf("webhook must be an http or https url: %q", c.Val())
+				}
+				config.webhooks = append(config.webhooks, c.Val())
+
+			case "webhook_secret":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.webhook_secret = c.Val()
+
+			case "webhook_retries":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.webhook_retries, err = strconv.Atoi(c.Val())
+				if err != nil || config.webhook_retries < 0 {
+					return config, c.Errf("webhook_retries must be a number >= 0: %q", c.Val())
+				}
+
+			case "structured_log":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					args = eventLogTypes
+				}
+				for _, arg := range args {
+					if !slices.Contains(eventLogTypes, arg) {
+						return config, c.Errf("structured_log events must be one of %s: %q", strings.Join(eventLogTypes, ", "), arg)
+					}
+				}
+				config.structured_log = args
+
+			case "structured_log_format":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				if !slices.Contains(eventLogFormats, c.Val()) {
+					return config, c.Errf("structured_log_format must be one of %s: %q", strings.Join(eventLogFormats, ", "), c.Val())
+				}
+				config.structured_log_format = c.Val()
+
+			case "site_workers":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.site_workers, err = strconv.Atoi(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+				if config.site_workers < 1 {
+					return config, c.Errf("site_workers must be at least 1: %q", c.Val())
+				}
+
+			case "record":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return config, c.ArgErr()
+				}
+				rr, err := parseStaticRecord(strings.Join(args, " "))
+				if err != nil {
+					return config, c.Errf("invalid record: %v", err)
+				}
+				config.records = append(config.records, rr)
+
+			case "include_zonefile":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return config, c.ArgErr()
+				}
+				zf := zoneFile{path: args[0], origin: "."}
+				if len(args) == 2 {
+					zf.origin = args[1]
+				}
+				if _, err := readZoneFile(zf); err != nil {
+					return config, c.Errf("invalid zone file %q: %v", zf.path, err)
+				}
+				config.zonefiles = append(config.zonefiles, zf)
+
+			case "update_key":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return config, c.ArgErr()
+				}
+				name := strings.ToLower(dns.Fqdn(args[0]))
+				if _, err := base64.StdEncoding.DecodeString(args[1]); err != nil {
+					return config, c.Errf("update_key secret for %q must be base64 encoded", args[0])
+				}
+				if config.update_keys == nil {
+					config.update_keys = make(map[string]string)
+				}
+				config.update_keys[name] = args[1]
+
+			case "update_lifetime":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.update_lifetime, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+				if config.update_lifetime <= 0 {
+					return config, c.Errf("update_lifetime must be greater than zero: %q", c.Val())
+				}
+
+			case "update_override":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.update_override, err = strconv.ParseBool(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+
+			case "backoff_initial":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.backoff_initial, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+				if config.backoff_initial <= 0 {
+					return config, c.Errf("backoff_initial must be greater than zero: %q", c.Val())
+				}
+
+			case "backoff_max":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.backoff_max, err = time.ParseDuration(c.Val())
+				if err != nil {
+					return config, c.ArgErr()
+				}
+
+			case "backoff_multiplier":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.backoff_multiplier, err = strconv.ParseFloat(c.Val(), 64)
+				if err != nil {
+					return config, c.ArgErr()
+				}
+				if config.backoff_multiplier < 1 {
+					return config, c.Errf("backoff_multiplier must be at least 1: %q", c.Val())
+				}
+
+			case "backoff_jitter":
+				if !c.NextArg() {
+					return config, c.ArgErr()
+				}
+				config.backoff_jitter, err = strconv.ParseFloat(c.Val(), 64)
+				if err != nil {
+					return config, c.ArgErr()
+				}
+				if config.backoff_jitter < 0 || config.backoff_jitter > 1 {
+					return config, c.Errf("backoff_jitter must be between 0 and 1: %q", c.Val())
+				}
 
 			default:
 				return config, c.Errf("unknown property: %q", c.Val())
@@ -164,6 +721,25 @@ func parse(c *caddy.Controller) (config config, err error) {
 
 	}
 
+	if config.backoff_max < config.backoff_initial {
+		return config, c.Errf("backoff_max (%s) must not be less than backoff_initial (%s)", config.backoff_max, config.backoff_initial)
+	}
+
+	config.site_filter, err = newSiteFilter(config.Site, config.exclude_site, config.site_match == "exact")
+	if err != nil {
+		return config, c.Errf("%v", err)
+	}
+
+	if config.tls.enabled() {
+		if !strings.HasPrefix(strings.ToLower(config.Controller_url), "https://") {
+			return config, c.Errf("tls options require an https controller_url: %q", config.Controller_url)
+		}
+		config.tls_config, err = config.tls.tlsConfig()
+		if err != nil {
+			return config, c.Errf("tls: %v", err)
+		}
+	}
+
 	validate := validator.New()
 	if err := validate.Struct(config); err != nil {
 		log.Info("There is a Corefile configuration error:")
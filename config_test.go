@@ -1,9 +1,13 @@
 package coredns_omada
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConfig(t *testing.T) {
@@ -51,6 +55,80 @@ func TestConfig(t *testing.T) {
 			fallback caddy
 }`, false},
 
+		// valid config with multiple sites and exclusions
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site Home Branch-.*
+			exclude_site Branch-Test
+}`, false},
+
+		// valid config with exact site matching
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site "Home (main)"
+			site_match exact
+}`, false},
+
+		// invalid value: site regex
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site "Home (main"
+}`, true},
+
+		// invalid value: exclude_site regex
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			exclude_site [
+}`, true},
+
+		// invalid value: site_match
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			site_match glob
+}`, true},
+
+		// valid config with filters
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			client_filter exclude ssid Guest-WiFi IoT
+			client_filter exclude guest true
+			device_filter include network LAN
+			dhcp_reservation_filter exclude vlan 30
+}`, false},
+
+		// invalid value: client_filter field
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			client_filter exclude colour blue
+}`, true},
+
+		// invalid value: device_filter field only valid for clients
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			device_filter exclude ssid Guest-WiFi
+}`, true},
+
 		// missing required property: controller url
 		{`omada {
 			username test
@@ -106,6 +184,70 @@ func TestConfig(t *testing.T) {
 			refresh_login_hours test
 }`, true},
 
+		// valid config with refresh durations
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			refresh 30s
+			login_refresh 12h
+}`, false},
+
+		// invalid value: refresh_minutes zero
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			refresh_minutes 0
+}`, true},
+
+		// invalid value: refresh
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			refresh 1
+}`, true},
+
+		// invalid value: refresh below minimum
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			refresh 1s
+}`, true},
+
+		// invalid value: login_refresh below minimum
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			login_refresh 10s
+}`, true},
+
+		// valid config with site discovery disabled
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			site_refresh 0
+}`, false},
+
+		// invalid value: site_refresh below minimum
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			site_refresh 10s
+}`, true},
+
 		// invalid value: resolve_clients
 		{`omada {
 			controller_url https://10.0.0.1
@@ -115,6 +257,63 @@ func TestConfig(t *testing.T) {
 			resolve_clients error
 }`, true},
 
+		// valid config with client presence options
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			clients_active_only true
+			clients_use_last_seen true
+}`, false},
+
+		// invalid value: clients_active_only
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			clients_active_only maybe
+}`, true},
+
+		// invalid value: clients_use_last_seen
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			clients_use_last_seen maybe
+}`, true},
+
+		// valid config with known clients
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			resolve_known_clients true
+			known_clients_ttl 5m
+			known_clients_retention 168h
+}`, false},
+
+		// invalid value: known_clients_ttl
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			known_clients_ttl 0s
+}`, true},
+
+		// invalid value: known_clients_retention
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			known_clients_retention forever
+}`, true},
+
 		// invalid value: resolve_devices
 		{`omada {
 			controller_url https://10.0.0.1
@@ -151,6 +350,130 @@ func TestConfig(t *testing.T) {
 			ignore_startup_errors zzz
 }`, true},
 
+		// valid config with backoff settings
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			backoff_initial 5s
+			backoff_max 5m
+			backoff_multiplier 1.5
+			backoff_jitter 0.1
+}`, false},
+
+		// invalid value: backoff_initial
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			backoff_initial 0s
+}`, true},
+
+		// invalid value: backoff_max less than backoff_initial
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			backoff_initial 1m
+			backoff_max 30s
+}`, true},
+
+		// invalid value: backoff_multiplier
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			backoff_multiplier 0.5
+}`, true},
+
+		// invalid value: backoff_jitter
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			backoff_jitter 2
+}`, true},
+
+		// valid config with site workers
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			site_workers 8
+}`, false},
+
+		// invalid value: site_workers
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			site_workers 0
+}`, true},
+
+		// valid config with dynamic updates
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			update_key update-key c2VjcmV0
+			update_lifetime 12h
+			update_override true
+}`, false},
+
+		// invalid value: update_key secret
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			update_key update-key not-base64!
+}`, true},
+
+		// invalid value: update_key missing secret
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			update_key update-key
+}`, true},
+
+		// valid config with static records
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			record www.omada.home. 300 IN CNAME proxy.omada.home.
+			record "omada.home. 300 IN MX 10 mail.omada.home."
+}`, false},
+
+		// invalid value: record
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			record www.omada.home. 300 IN CNAME
+}`, true},
+
+		// invalid value: include_zonefile does not exist
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			include_zonefile /nonexistent/omada.home omada.home
+}`, true},
+
 		// valid config with empty fallback (no fallback configured)
 		{`omada {
 			controller_url https://10.0.0.1
@@ -187,20 +510,436 @@ func TestConfig(t *testing.T) {
 			fallback "api.-server.example.com"
 }`, true},
 
-		// invalid value: fallback with IPv6 address (not supported)
+		// valid config with fallback IPv6 address
 		{`omada {
 			controller_url https://10.0.0.1
 			username test
 			password test
 			site .*
 			fallback "2001:db8::1"
-}`, true},
-	}
+}`, false},
 
-	for i, test := range tests {
-		c := caddy.NewTestController("dns", test.config)
-		if _, err := parse(c); (err == nil) == test.expectedError {
-			t.Fatalf("Unexpected errors: %v in test: %d\n\t%s", err, i, test.config)
-		}
+		// valid config with multiple fallback targets
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback 192.168.1.100 2001:db8::1 caddy
+}`, false},
+
+		// valid config with fallback cname
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback_cname proxy.example.com
+}`, false},
+
+		// invalid value: fallback cname with IP address
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback_cname 192.168.1.100
+}`, true},
+
+		// valid config with fallback exclusions
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback 192.168.1.100
+			fallback_exclude wpad _dmarc isatap
+			fallback_exclude_regex ^autodiscover ^_.*
+}`, false},
+
+		// invalid value: fallback exclusion without labels
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback_exclude
+}`, true},
+
+		// invalid value: fallback exclusion with invalid regex
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback_exclude_regex "(unclosed"
+}`, true},
+
+		// valid config with fallback mode
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback 192.168.1.100
+			fallback_mode single_label
+}`, false},
+
+		// invalid value: unknown fallback mode
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback_mode some
+}`, true},
+
+		// valid config with fallback resolver
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback proxy.example.com
+			fallback_resolver 192.168.1.1
+}`, false},
+
+		// valid config with fallback resolver and port
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback proxy.example.com
+			fallback_resolver [2001:db8::53]:5353
+}`, false},
+
+		// invalid value: fallback resolver without address
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback_resolver :53
+}`, true},
+
+		// valid config with admin api
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			admin_listen 127.0.0.1:8053
+}`, false},
+
+		// invalid value: admin api address without port
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			admin_listen 127.0.0.1
+}`, true},
+
+		// valid config with admin token and refresh debounce
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			admin_listen 127.0.0.1:8053
+			admin_token secret
+			refresh_debounce 1m
+}`, false},
+
+		// invalid value: refresh debounce too short
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			refresh_debounce 1s
+}`, true},
+
+		// valid config with zone export
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			export_zone_dir /tmp
+}`, false},
+
+		// invalid value: zone export directory does not exist
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			export_zone_dir /nonexistent/zones
+}`, true},
+
+		// valid config with hosts exports
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			export_hosts hosts /tmp/omada.hosts
+			export_hosts dnsmasq /tmp/omada.conf
+			export_hosts unbound /tmp/omada-unbound.conf
+}`, false},
+
+		// invalid value: unknown hosts export format
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			export_hosts bind /tmp/omada.hosts
+}`, true},
+
+		// invalid value: hosts export directory does not exist
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			export_hosts hosts /nonexistent/omada.hosts
+}`, true},
+
+		// valid config with a change log
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			change_log /tmp/omada-changes.jsonl
+}`, false},
+
+		// invalid value: change log directory does not exist
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			change_log /nonexistent/changes.jsonl
+}`, true},
+
+		// valid config with webhooks
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			webhook https://hooks.example.com/omada
+			webhook http://10.0.0.5:8123/api/webhook/omada
+			webhook_secret secret
+			webhook_retries 5
+}`, false},
+
+		// invalid value: webhook is not an http url
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			webhook ftp://hooks.example.com/omada
+}`, true},
+
+		// invalid value: negative webhook retries
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			webhook https://hooks.example.com/omada
+			webhook_retries -1
+}`, true},
+
+		// valid config with structured logging
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			structured_log
+			structured_log_format json
+}`, false},
+
+		// valid config with structured refresh events only
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			structured_log refresh
+}`, false},
+
+		// invalid value: unknown structured log event
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			structured_log updates
+}`, true},
+
+		// invalid value: unknown structured log format
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			structured_log_format xml
+}`, true},
+
+		// valid config with a pinned certificate
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			tls_pin_sha256 9F:86:D0:81:88:4C:7D:65:9A:2F:EA:A0:C5:5A:D0:15:A3:BF:4F:1B:2B:0B:82:2C:D1:5D:6C:15:B0:F0:0A:08
+			tls_server_name omada.example.com
+}`, false},
+
+		// valid config without certificate verification
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			insecure_skip_verify true
+}`, false},
+
+		// invalid value: pin is not a sha-256 fingerprint
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			tls_pin_sha256 9f86d081
+}`, true},
+
+		// invalid value: ca file does not exist
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			tls_ca_file /nonexistent/ca.pem
+}`, true},
+
+		// invalid value: verification is disabled and a certificate is pinned
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			insecure_skip_verify true
+			tls_pin_sha256 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+}`, true},
+
+		// invalid value: tls options for a plain http controller
+		{`omada {
+			controller_url http://10.0.0.1
+			username test
+			password test
+			site .*
+			insecure_skip_verify true
+}`, true},
+
+		// valid config with zone fallbacks
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			fallback 192.168.1.100
+			zone_fallback iot.omada.home 192.168.20.2 2001:db8::2
+			zone_fallback_cname lan.omada.home proxy.example.com
+}`, false},
+
+		// invalid value: zone fallback without targets
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			zone_fallback iot.omada.home
+}`, true},
+
+		// invalid value: zone fallback with invalid characters
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			zone_fallback iot.omada.home "invalid@domain"
+}`, true},
+
+		// invalid value: zone fallback cname without target
+		{`omada {
+			controller_url https://10.0.0.1
+			username test
+			password test
+			site .*
+			zone_fallback_cname lan.omada.home
+}`, true},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.config)
+		if _, err := parse(c); (err == nil) == test.expectedError {
+			t.Fatalf("Unexpected errors: %v in test: %d\n\t%s", err, i, test.config)
+		}
+	}
+}
+
+func TestConfigCredentialFiles(t *testing.T) {
+
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	emptyFile := filepath.Join(dir, "empty")
+	os.WriteFile(usernameFile, []byte("viewer\n"), 0o600)
+	os.WriteFile(passwordFile, []byte("secret\n"), 0o600)
+	os.WriteFile(emptyFile, nil, 0o600)
+
+	tests := []struct {
+		name          string
+		credentials   string
+		expectedError bool
+	}{
+		{"files", fmt.Sprintf("username_file %s\npassword_file %s", usernameFile, passwordFile), false},
+		{"password file", fmt.Sprintf("username test\npassword_file %s", passwordFile), false},
+		{"missing file", fmt.Sprintf("username test\npassword_file %s", filepath.Join(dir, "missing")), true},
+		{"empty file", fmt.Sprintf("username test\npassword_file %s", emptyFile), true},
+		{"password and password file", fmt.Sprintf("username test\npassword test\npassword_file %s", passwordFile), true},
+		{"username file and username", fmt.Sprintf("username_file %s\nusername test\npassword test", usernameFile), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", fmt.Sprintf(`omada {
+				controller_url https://10.0.0.1
+				site .*
+				%s
+}`, tt.credentials))
+			config, err := parse(c)
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("Unexpected error: %v\n\t%s", err, tt.credentials)
+			}
+			if err != nil {
+				return
+			}
+			username, password, err := config.credentials()
+			if err != nil {
+				t.Fatalf("failed to read credentials: %v", err)
+			}
+			assert.NotEmpty(t, username)
+			assert.Equal(t, "secret", password)
+		})
 	}
 }
@@ -0,0 +1,194 @@
+package coredns_omada
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// serveUpdate handles RFC 2136 dynamic update messages for the managed forward
+// zones. Updates must be signed with one of the configured TSIG keys; the
+// signature itself is verified by the server using the secrets registered in
+// setup. Only A records can be added or removed, matching PTR records are
+// maintained automatically.
+func (o *Omada) serveUpdate(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+
+	if len(o.config.update_keys) == 0 {
+		return plugin.NextOrFailure(o.Name(), o.Next, ctx, w, r)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	// the zone section must contain exactly one SOA question for a managed zone
+	if len(r.Question) != 1 || r.Question[0].Qtype != dns.TypeSOA {
+		return o.writeUpdateReply(w, r, m, dns.RcodeFormatError)
+	}
+	zone := strings.ToLower(dns.Fqdn(r.Question[0].Name))
+	o.zMu.RLock()
+	zoneName := plugin.Zones(o.zoneNames).Matches(zone)
+	o.zMu.RUnlock()
+	if zoneName == "" {
+		return plugin.NextOrFailure(o.Name(), o.Next, ctx, w, r)
+	}
+	if zoneName != zone || zone == ptrZone {
+		log.Debugf("update: rejecting dynamic update for zone: %s", zone)
+		return o.writeUpdateReply(w, r, m, dns.RcodeNotZone)
+	}
+
+	// authenticate the update
+	tsig := r.IsTsig()
+	if tsig == nil {
+		log.Debugf("update: rejecting unsigned dynamic update for zone: %s", zone)
+		return o.writeUpdateReply(w, r, m, dns.RcodeRefused)
+	}
+	if _, ok := o.config.update_keys[strings.ToLower(tsig.Hdr.Name)]; !ok {
+		log.Debugf("update: rejecting dynamic update signed with unknown key: %s", tsig.Hdr.Name)
+		return o.writeUpdateReply(w, r, m, dns.RcodeNotAuth)
+	}
+	if err := w.TsigStatus(); err != nil {
+		log.Debugf("update: rejecting dynamic update with invalid signature: %v", err)
+		return o.writeUpdateReply(w, r, m, dns.RcodeNotAuth)
+	}
+
+	// prerequisites are not supported
+	if len(r.Answer) > 0 {
+		return o.writeUpdateReply(w, r, m, dns.RcodeNotImplemented)
+	}
+
+	o.uMu.Lock()
+	defer o.uMu.Unlock()
+
+	rcode := o.applyUpdate(zone, r.Ns)
+	if rcode == dns.RcodeSuccess {
+		o.buildZones(o.records)
+	}
+	return o.writeUpdateReply(w, r, m, rcode)
+}
+
+// applyUpdate validates and applies the update section of a dynamic update.
+// Nothing is applied unless every record in the update is valid. Callers must
+// hold uMu.
+func (o *Omada) applyUpdate(zone string, updates []dns.RR) int {
+
+	// validate before changing anything, updates are all or nothing
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		if !dns.IsSubDomain(zone, name) {
+			return dns.RcodeNotZone
+		}
+		switch hdr.Class {
+		case dns.ClassINET:
+			if hdr.Rrtype != dns.TypeA {
+				return dns.RcodeRefused
+			}
+			// an add with empty rdata has no address
+			if a, ok := rr.(*dns.A); !ok || a.A.To4() == nil {
+				return dns.RcodeFormatError
+			}
+			if _, exists := o.records[zone].ARecords[name]; exists && !o.config.update_override {
+				log.Warningf("update: refusing dynamic update which would replace controller record: %s", name)
+				return dns.RcodeRefused
+			}
+		case dns.ClassANY, dns.ClassNONE:
+			if hdr.Rrtype != dns.TypeA && hdr.Rrtype != dns.TypeANY {
+				return dns.RcodeRefused
+			}
+		default:
+			return dns.RcodeFormatError
+		}
+	}
+
+	if o.updates == nil {
+		o.updates = make(map[string]DnsRecords)
+	}
+	for _, z := range []string{zone, ptrZone} {
+		if _, ok := o.updates[z]; !ok {
+			o.updates[z] = DnsRecords{
+				ARecords:   make(map[string]ARecord),
+				PtrRecords: make(map[string]PtrRecord),
+			}
+		}
+	}
+
+	timestamp := time.Now()
+	for _, rr := range updates {
+		hdr := rr.Header()
+		name := strings.ToLower(hdr.Name)
+		switch hdr.Class {
+		case dns.ClassINET:
+			a := rr.(*dns.A)
+			o.removeDynamicRecord(zone, name)
+			record := &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: hdr.Ttl},
+				A: a.A}
+			o.updates[zone].ARecords[name] = ARecord{
+				record:     record,
+				timestamp:  timestamp,
+				maxAge:     o.config.update_lifetime,
+				recordInfo: recordInfo{source: "dynamic"},
+			}
+
+			ptrName := getPtrZoneFromIp(a.A.String())
+			if _, exists := o.records[ptrZone].PtrRecords[ptrName]; !exists || o.config.update_override {
+				ptr := &dns.PTR{Hdr: dns.RR_Header{Name: ptrName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: hdr.Ttl},
+					Ptr: name}
+				o.updates[ptrZone].PtrRecords[ptrName] = PtrRecord{
+					record:     ptr,
+					timestamp:  timestamp,
+					maxAge:     o.config.update_lifetime,
+					recordInfo: recordInfo{source: "dynamic"},
+				}
+			}
+			log.Infof("update: dynamic update added record: %s -> %s", name, a.A)
+
+		case dns.ClassANY:
+			// delete all records for the name
+			o.removeDynamicRecord(zone, name)
+			log.Infof("update: dynamic update removed records for: %s", name)
+
+		case dns.ClassNONE:
+			// delete a specific record
+			a, ok := rr.(*dns.A)
+			if !ok {
+				continue
+			}
+			existing, exists := o.updates[zone].ARecords[name]
+			if exists && existing.record.A.Equal(a.A) {
+				o.removeDynamicRecord(zone, name)
+				log.Infof("update: dynamic update removed record: %s -> %s", name, a.A)
+			}
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// removeDynamicRecord removes a dynamic A record and the PTR record pointing to it
+func (o *Omada) removeDynamicRecord(zone string, name string) {
+
+	existing, ok := o.updates[zone].ARecords[name]
+	if !ok {
+		return
+	}
+	delete(o.updates[zone].ARecords, name)
+
+	ptrName := getPtrZoneFromIp(existing.record.A.String())
+	if ptr, ok := o.updates[ptrZone].PtrRecords[ptrName]; ok && ptr.record.Ptr == name {
+		delete(o.updates[ptrZone].PtrRecords, ptrName)
+	}
+}
+
+// writeUpdateReply writes the response to a dynamic update, signing it when the
+// request was signed
+func (o *Omada) writeUpdateReply(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg, rcode int) (int, error) {
+	m.Rcode = rcode
+	if tsig := r.IsTsig(); tsig != nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+	return dns.RcodeSuccess, nil
+}
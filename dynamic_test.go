@@ -0,0 +1,198 @@
+package coredns_omada
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func testDynamicOmada() *Omada {
+
+	dnsDomain := "omada.test."
+	fqdn := "client1.omada.test."
+	ptrName := getPtrZoneFromIp("192.168.0.101")
+	records := map[string]DnsRecords{
+		dnsDomain: {
+			ARecords: map[string]ARecord{
+				fqdn: {
+					record: &dns.A{Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+						A: net.ParseIP("192.168.0.101")},
+					timestamp: time.Now(),
+				},
+			},
+			PtrRecords: make(map[string]PtrRecord),
+		},
+		ptrZone: {
+			ARecords: make(map[string]ARecord),
+			PtrRecords: map[string]PtrRecord{
+				ptrName: {
+					record: &dns.PTR{Hdr: dns.RR_Header{Name: ptrName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+						Ptr: fqdn},
+					timestamp: time.Now(),
+				},
+			},
+		},
+	}
+
+	o := &Omada{Next: testHandler()}
+	o.config.stale_record_duration = 10 * time.Minute
+	o.config.update_lifetime = time.Hour
+	o.config.update_keys = map[string]string{"update-key.": "c2VjcmV0"}
+	o.buildZones(records)
+	return o
+}
+
+func sendUpdate(t *testing.T, o *Omada, key string, insert []dns.RR, remove []dns.RR) int {
+
+	req := new(dns.Msg)
+	req.SetUpdate("omada.test.")
+	if len(insert) > 0 {
+		req.Insert(insert)
+	}
+	if len(remove) > 0 {
+		req.RemoveRRset(remove)
+	}
+	if key != "" {
+		req.SetTsig(key, dns.HmacSHA256, 300, time.Now().Unix())
+	}
+
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	_, err := o.ServeDNS(context.Background(), rec, req)
+	assert.NoError(t, err)
+	return rec.Msg.Rcode
+}
+
+func TestDynamicUpdate(t *testing.T) {
+
+	o := testDynamicOmada()
+	vm := test.A("vm1.omada.test. 120 IN A 192.168.0.150")
+
+	// unsigned and unknown keys are rejected
+	assert.Equal(t, dns.RcodeRefused, sendUpdate(t, o, "", []dns.RR{vm}, nil))
+	assert.Equal(t, dns.RcodeNotAuth, sendUpdate(t, o, "other-key.", []dns.RR{vm}, nil))
+
+	// signed update adds the record and its ptr record
+	assert.Equal(t, dns.RcodeSuccess, sendUpdate(t, o, "update-key.", []dns.RR{vm}, nil))
+	executeTestCases(t, o, []testCases{
+		{
+			qname:      "vm1.omada.test.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"vm1.omada.test.	120	IN	A	192.168.0.150"},
+		},
+		{
+			qname:      "150.0.168.192.in-addr.arpa.",
+			qtype:      dns.TypePTR,
+			wantAnswer: []string{"150.0.168.192.in-addr.arpa.	120	IN	PTR	vm1.omada.test."},
+		},
+		{ // controller records are still served
+			qname:      "client1.omada.test.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client1.omada.test.	60	IN	A	192.168.0.101"},
+		},
+	})
+
+	// controller records can not be replaced
+	clobber := test.A("client1.omada.test. 60 IN A 192.168.0.200")
+	assert.Equal(t, dns.RcodeRefused, sendUpdate(t, o, "update-key.", []dns.RR{clobber}, nil))
+
+	// unsupported record types are refused
+	txt := test.TXT(`vm1.omada.test. 60 IN TXT "hello"`)
+	assert.Equal(t, dns.RcodeRefused, sendUpdate(t, o, "update-key.", []dns.RR{txt}, nil))
+
+	// an add without an address is malformed
+	empty := &dns.A{Hdr: dns.RR_Header{Name: "vm2.omada.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}}
+	assert.Equal(t, dns.RcodeFormatError, sendUpdate(t, o, "update-key.", []dns.RR{empty}, nil))
+	assert.NotContains(t, o.updates["omada.test."].ARecords, "vm2.omada.test.")
+	assert.Len(t, o.updates[ptrZone].PtrRecords, 1)
+
+	// records can be removed
+	assert.Equal(t, dns.RcodeSuccess, sendUpdate(t, o, "update-key.", nil, []dns.RR{vm}))
+	executeTestCases(t, o, []testCases{
+		{
+			qname:        "vm1.omada.test.",
+			qtype:        dns.TypeA,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+	})
+}
+
+func TestDynamicUpdateOverride(t *testing.T) {
+
+	o := testDynamicOmada()
+	o.config.update_override = true
+
+	clobber := test.A("client1.omada.test. 60 IN A 192.168.0.200")
+	assert.Equal(t, dns.RcodeSuccess, sendUpdate(t, o, "update-key.", []dns.RR{clobber}, nil))
+	executeTestCases(t, o, []testCases{
+		{
+			qname:      "client1.omada.test.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client1.omada.test.	60	IN	A	192.168.0.200"},
+		},
+	})
+}
+
+func TestDynamicUpdateThenControllerRecord(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		override   bool
+		wantAnswer string
+	}{
+		{
+			name:       "controller record wins",
+			override:   false,
+			wantAnswer: "vm1.omada.test.	60	IN	A	192.168.0.160",
+		},
+		{
+			name:       "dynamic record wins with override",
+			override:   true,
+			wantAnswer: "vm1.omada.test.	120	IN	A	192.168.0.150",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			o := testDynamicOmada()
+			o.config.update_override = tc.override
+
+			vm := test.A("vm1.omada.test. 120 IN A 192.168.0.150")
+			assert.Equal(t, dns.RcodeSuccess, sendUpdate(t, o, "update-key.", []dns.RR{vm}, nil))
+
+			// a controller client with the same name appears on the next refresh
+			records := o.records
+			fqdn := "vm1.omada.test."
+			records["omada.test."].ARecords[fqdn] = ARecord{
+				record: &dns.A{Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A: net.ParseIP("192.168.0.160")},
+				timestamp: time.Now(),
+			}
+			o.buildZones(records)
+
+			executeTestCases(t, o, []testCases{
+				{
+					qname:      fqdn,
+					qtype:      dns.TypeA,
+					wantAnswer: []string{tc.wantAnswer},
+				},
+			})
+		})
+	}
+}
+
+func TestDynamicUpdateDisabled(t *testing.T) {
+
+	o := testDynamicOmada()
+	o.config.update_keys = nil
+
+	vm := test.A("vm1.omada.test. 120 IN A 192.168.0.150")
+	assert.Equal(t, dns.RcodeServerFailure, sendUpdate(t, o, "update-key.", []dns.RR{vm}, nil))
+}
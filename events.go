@@ -0,0 +1,109 @@
+package coredns_omada
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// eventLogTypes are the events which can be enabled with structured_log
+var eventLogTypes = []string{"refresh", "query"}
+
+// eventLogFormats are the supported structured_log_format values
+var eventLogFormats = []string{"logfmt", "json"}
+
+// eventLog writes structured key/value events about refreshes and queries for
+// log pipelines. Events are written independent of the debug setting, all
+// methods are no-ops on a nil eventLog.
+type eventLog struct {
+	logger  *slog.Logger
+	refresh bool
+	query   bool
+}
+
+// newEventLog returns an eventLog writing to w, or nil when structured_log is not set
+func newEventLog(w io.Writer, c config) *eventLog {
+
+	if len(c.structured_log) == 0 {
+		return nil
+	}
+	var handler slog.Handler
+	if c.structured_log_format == "json" {
+		handler = slog.NewJSONHandler(w, nil)
+	} else {
+		handler = slog.NewTextHandler(w, nil)
+	}
+	return &eventLog{
+		logger:  slog.New(handler).With("plugin", "omada"),
+		refresh: slices.Contains(c.structured_log, "refresh"),
+		query:   slices.Contains(c.structured_log, "query"),
+	}
+}
+
+// refreshSite logs the number of entries fetched for a site during a refresh
+func (e *eventLog) refreshSite(site string, result siteResult) {
+
+	if e == nil || !e.refresh {
+		return
+	}
+	attrs := []any{
+		"site", site,
+		"networks", len(result.data.networks),
+		"clients", len(result.data.clients),
+		"known_clients", len(result.data.knownClients),
+		"devices", len(result.data.devices),
+		"reservations", len(result.data.reservations),
+		"attempts", result.attempts,
+		"failures", len(result.failures),
+	}
+	if len(result.failures) > 0 {
+		attrs = append(attrs, "error", errors.Join(result.failures...).Error())
+		e.logger.Warn("refresh_site", attrs...)
+		return
+	}
+	e.logger.Info("refresh_site", attrs...)
+}
+
+// refreshDone logs the outcome of a refresh which started at start
+func (e *eventLog) refreshDone(start time.Time, sites int, records int, attempts int, failures []error, err error) {
+
+	if e == nil || !e.refresh {
+		return
+	}
+	attrs := []any{
+		"duration_ms", time.Since(start).Milliseconds(),
+		"sites", sites,
+		"records", records,
+		"attempts", attempts,
+		"failures", len(failures),
+	}
+	if err != nil {
+		e.logger.Error("refresh", append(attrs, "error", err.Error())...)
+		return
+	}
+	e.logger.Info("refresh", attrs...)
+}
+
+// queryDecision logs how a query was handled. decision is one of answer,
+// nodata, nxdomain, excluded, delegation, cname_alias, servfail,
+// unsupported_type, unmanaged_zone or no_answer. The last three pass the
+// query to the next plugin.
+func (e *eventLog) queryDecision(qname string, qtype uint16, zone string, decision string, answers int) {
+
+	if e == nil || !e.query {
+		return
+	}
+	next := decision == "unsupported_type" || decision == "unmanaged_zone" || decision == "no_answer"
+	e.logger.Info("query",
+		"qname", qname,
+		"qtype", dns.TypeToString[qtype],
+		"zone", zone,
+		"decision", decision,
+		"answers", answers,
+		"next", next,
+	)
+}
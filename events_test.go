@@ -0,0 +1,154 @@
+package coredns_omada
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// parseEvents decodes json events written by an eventLog
+func parseEvents(t *testing.T, b *bytes.Buffer) []map[string]any {
+
+	var events []map[string]any
+	scanner := bufio.NewScanner(b)
+	for scanner.Scan() {
+		var event map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("failed to decode event %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestEventLog(t *testing.T) {
+
+	// disabled
+	var b bytes.Buffer
+	e := newEventLog(&b, config{structured_log_format: "json"})
+	assert.Nil(t, e)
+	e.refreshDone(time.Now(), 1, 10, 4, nil, nil)
+	e.queryDecision("client-001.omada.home.", dns.TypeA, "omada.home.", "answer", 1)
+	assert.Empty(t, b.String())
+
+	// only the enabled events are written
+	e = newEventLog(&b, config{structured_log: []string{"query"}, structured_log_format: "json"})
+	e.refreshDone(time.Now(), 1, 10, 4, nil, nil)
+	e.queryDecision("client-001.omada.home.", dns.TypeA, "omada.home.", "answer", 1)
+	e.queryDecision("example.com.", dns.TypeMX, "", "unsupported_type", 0)
+	events := parseEvents(t, &b)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "query", events[0]["msg"])
+	assert.Equal(t, "omada", events[0]["plugin"])
+	assert.Equal(t, "client-001.omada.home.", events[0]["qname"])
+	assert.Equal(t, "A", events[0]["qtype"])
+	assert.Equal(t, "answer", events[0]["decision"])
+	assert.Equal(t, false, events[0]["next"])
+	assert.Equal(t, "MX", events[1]["qtype"])
+	assert.Equal(t, true, events[1]["next"])
+
+	// failed refreshes are logged as errors
+	e = newEventLog(&b, config{structured_log: []string{"refresh"}, structured_log_format: "json"})
+	e.refreshDone(time.Now(), 1, 0, 4, []error{errors.New("timeout")}, errors.New("timeout"))
+	events = parseEvents(t, &b)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "ERROR", events[0]["level"])
+	assert.Equal(t, "timeout", events[0]["error"])
+	assert.Equal(t, float64(1), events[0]["failures"])
+
+	// logfmt
+	e = newEventLog(&b, config{structured_log: eventLogTypes, structured_log_format: "logfmt"})
+	e.queryDecision("client-001.omada.home.", dns.TypeA, "omada.home.", "answer", 1)
+	assert.Contains(t, b.String(), `level=INFO msg=query plugin=omada qname=client-001.omada.home. qtype=A zone=omada.home. decision=answer answers=1 next=false`)
+}
+
+func TestUpdateWithEventLog(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithEventLog/NewOmada': %v", err)
+	}
+	var b bytes.Buffer
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.events = newEventLog(&b, config{structured_log: eventLogTypes, structured_log_format: "json"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithEventLog/controllerInit': %v", err)
+	}
+
+	tests := []testCases{
+		{
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+		{
+			qname:        "app.omada.home.",
+			qtype:        dns.TypeA,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+		{
+			qname:        "www.example.com.",
+			qtype:        dns.TypeA,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+
+	events := parseEvents(t, &b)
+	if !assert.Len(t, events, 5) {
+		return
+	}
+
+	site := events[0]
+	assert.Equal(t, "refresh_site", site["msg"])
+	assert.Equal(t, "Home", site["site"])
+	assert.Greater(t, site["clients"], float64(0))
+	assert.Greater(t, site["devices"], float64(0))
+	assert.Greater(t, site["reservations"], float64(0))
+	assert.Equal(t, float64(0), site["failures"])
+
+	refresh := events[1]
+	assert.Equal(t, "refresh", refresh["msg"])
+	assert.Equal(t, "INFO", refresh["level"])
+	assert.Equal(t, float64(1), refresh["sites"])
+	assert.Greater(t, refresh["records"], float64(0))
+	assert.Contains(t, refresh, "duration_ms")
+
+	for i, want := range []struct {
+		decision string
+		zone     string
+		next     bool
+	}{
+		{"answer", "omada.home.", false},
+		{"no_answer", "omada.home.", true},
+		{"unmanaged_zone", "", true},
+	} {
+		event := events[2+i]
+		assert.Equal(t, "query", event["msg"])
+		assert.Equal(t, want.decision, event["decision"])
+		assert.Equal(t, want.zone, event["zone"])
+		assert.Equal(t, want.next, event["next"])
+	}
+}
@@ -0,0 +1,195 @@
+package coredns_omada
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/coredns/coredns/plugin/file/tree"
+	"github.com/miekg/dns"
+)
+
+// renderZoneFile renders a zone in RFC 1035 zone file format. The zones don't
+// have NS records unless they were added as static records, so an NS record
+// for the SOA's name server is added to keep the zone loadable by other servers.
+func renderZoneFile(zoneName string, zone *file.Zone) ([]byte, error) {
+
+	apex, err := zone.ApexIfDefined()
+	if err != nil {
+		return nil, fmt.Errorf("zone %s: %w", zoneName, err)
+	}
+	if len(zone.NS) == 0 {
+		soa := apex[0].(*dns.SOA)
+		apex = append(apex, &dns.NS{Hdr: dns.RR_Header{Name: zoneName, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: soa.Hdr.Ttl},
+			Ns: soa.Ns})
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "; zone %s generated by the coredns omada plugin\n", zoneName)
+	fmt.Fprintf(&b, "$ORIGIN %s\n", zoneName)
+	for _, rr := range apex {
+		fmt.Fprintln(&b, rr.String())
+	}
+	zone.Walk(func(e *tree.Elem, _ map[uint16][]dns.RR) error {
+		for _, rr := range e.All() {
+			fmt.Fprintln(&b, rr.String())
+		}
+		return nil
+	})
+	return b.Bytes(), nil
+}
+
+// zoneFileName returns the name of the file a zone is exported to
+func zoneFileName(zoneName string) string {
+	return strings.TrimSuffix(zoneName, ".") + ".zone"
+}
+
+// exportZoneFiles writes every zone to export_zone_dir. Failures are logged
+// and don't affect the zones being served.
+func (o *Omada) exportZoneFiles(zones map[string]*file.Zone) {
+
+	if o.config.export_zone_dir == "" {
+		return
+	}
+	for zoneName, zone := range zones {
+		data, err := renderZoneFile(zoneName, zone)
+		if err != nil {
+			log.Warningf("export: failed to render zone %s: %v", zoneName, err)
+			continue
+		}
+		path := filepath.Join(o.config.export_zone_dir, zoneFileName(zoneName))
+		if err := writeFileAtomic(path, data); err != nil {
+			log.Warningf("export: failed to write zone %s: %v", zoneName, err)
+			continue
+		}
+		log.Debugf("export: wrote zone %s to %s", zoneName, path)
+	}
+}
+
+// hostsExport is a file the A, AAAA and PTR records are written to in a format
+// other resolvers can load
+type hostsExport struct {
+	format string // hosts, dnsmasq or unbound
+	path   string
+}
+
+// hostsFormats are the supported hostsExport formats
+var hostsFormats = []string{"hosts", "dnsmasq", "unbound"}
+
+// hostRecords returns the address and PTR records of the zones sorted by name.
+// Wildcards are skipped as they can't be expressed in every format.
+func hostRecords(zones map[string]*file.Zone) (addresses []dns.RR, ptrs []dns.RR) {
+
+	for zoneName, zone := range zones {
+		zone.Walk(func(e *tree.Elem, _ map[uint16][]dns.RR) error {
+			if strings.HasPrefix(e.Name(), "*.") {
+				return nil
+			}
+			if zoneName == ptrZone {
+				ptrs = append(ptrs, e.Type(dns.TypePTR)...)
+				return nil
+			}
+			addresses = append(addresses, e.Type(dns.TypeA)...)
+			addresses = append(addresses, e.Type(dns.TypeAAAA)...)
+			return nil
+		})
+	}
+	sortRecords(addresses)
+	sortRecords(ptrs)
+	return addresses, ptrs
+}
+
+// sortRecords sorts records by name and then by their data
+func sortRecords(records []dns.RR) {
+	slices.SortFunc(records, func(a, b dns.RR) int {
+		return cmp.Or(strings.Compare(a.Header().Name, b.Header().Name), strings.Compare(a.String(), b.String()))
+	})
+}
+
+// renderHosts renders the address and PTR records in one of the hostsFormats
+func renderHosts(format string, addresses []dns.RR, ptrs []dns.RR) []byte {
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# generated by the coredns omada plugin")
+	for _, rr := range addresses {
+		name := strings.TrimSuffix(rr.Header().Name, ".")
+		ip := addressOf(rr)
+		switch format {
+		case "hosts":
+			fmt.Fprintf(&b, "%s\t%s\n", ip, name)
+		case "dnsmasq":
+			fmt.Fprintf(&b, "address=/%s/%s\n", name, ip)
+		case "unbound":
+			fmt.Fprintf(&b, "local-data: \"%s\"\n", rr.String())
+		}
+	}
+	// the hosts format has no PTR records, resolvers derive them from the addresses
+	for _, rr := range ptrs {
+		ptr := rr.(*dns.PTR)
+		switch format {
+		case "dnsmasq":
+			fmt.Fprintf(&b, "ptr-record=%s,%s\n", strings.TrimSuffix(ptr.Hdr.Name, "."), strings.TrimSuffix(ptr.Ptr, "."))
+		case "unbound":
+			fmt.Fprintf(&b, "local-data: \"%s\"\n", ptr.String())
+		}
+	}
+	return b.Bytes()
+}
+
+// addressOf returns the address of an A or AAAA record
+func addressOf(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// exportHosts writes the address and PTR records to every export_hosts file.
+// Failures are logged and don't affect the zones being served.
+func (o *Omada) exportHosts(zones map[string]*file.Zone) {
+
+	if len(o.config.hosts_exports) == 0 {
+		return
+	}
+	addresses, ptrs := hostRecords(zones)
+	for _, export := range o.config.hosts_exports {
+		if err := writeFileAtomic(export.path, renderHosts(export.format, addresses, ptrs)); err != nil {
+			log.Warningf("export: failed to write %s file %s: %v", export.format, export.path, err)
+			continue
+		}
+		log.Debugf("export: wrote %d records to %s file %s", len(addresses)+len(ptrs), export.format, export.path)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
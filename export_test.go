@@ -0,0 +1,217 @@
+package coredns_omada
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// parseZoneFile parses a rendered zone file back into records
+func parseZoneFile(t *testing.T, data []byte) []dns.RR {
+	var records []dns.RR
+	zp := dns.NewZoneParser(bytes.NewReader(data), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatalf("failed to parse zone file: %v\n%s", err, data)
+	}
+	return records
+}
+
+func TestRenderZoneFile(t *testing.T) {
+
+	zone := file.NewZone("omada.home.", "")
+	addSoaRecord(zone, "omada.home.")
+	zone.Insert(&dns.A{Hdr: dns.RR_Header{Name: "client1.omada.home.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A: net.ParseIP("10.0.0.101")})
+	zone.Insert(&dns.A{Hdr: dns.RR_Header{Name: "*.omada.home.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A: net.ParseIP("10.0.0.200")})
+	zone.Insert(mustParseStaticRecord(t, "www.omada.home. 300 IN CNAME client1.omada.home."))
+
+	data, err := renderZoneFile("omada.home.", zone)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	records := parseZoneFile(t, data)
+	var got []string
+	for _, rr := range records {
+		got = append(got, rr.String())
+	}
+	assert.Equal(t, []string{
+		"omada.home.	300	IN	SOA	ns.omada.home. hostmaster.omada.home. 1 7200 3600 86400 300",
+		"omada.home.	300	IN	NS	ns.omada.home.",
+		"*.omada.home.	60	IN	A	10.0.0.200",
+		"client1.omada.home.	60	IN	A	10.0.0.101",
+		"www.omada.home.	300	IN	CNAME	client1.omada.home.",
+	}, got)
+
+	// static NS records replace the generated one
+	zone.Insert(mustParseStaticRecord(t, "omada.home. 300 IN NS dns.omada.home."))
+	data, err = renderZoneFile("omada.home.", zone)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	assert.Equal(t, "omada.home.	300	IN	NS	dns.omada.home.", parseZoneFile(t, data)[1].String())
+
+	// zones without a SOA can't be rendered
+	_, err = renderZoneFile("empty.home.", file.NewZone("empty.home.", ""))
+	assert.Error(t, err)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "omada.home.zone")
+
+	assert.NoError(t, writeFileAtomic(path, []byte("first\n")))
+	assert.NoError(t, writeFileAtomic(path, []byte("second\n")))
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second\n", string(data))
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	assert.Error(t, writeFileAtomic(filepath.Join(dir, "missing", "omada.home.zone"), []byte("data\n")))
+}
+
+func TestUpdateExportsZoneFiles(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateExportsZoneFiles/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.export_zone_dir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateExportsZoneFiles/controllerInit': %v", err)
+	}
+
+	for _, name := range []string{"omada.home.zone", "omada.work.zone", "in-addr.arpa.zone"} {
+		data, err := os.ReadFile(filepath.Join(testOmada.config.export_zone_dir, name))
+		if err != nil {
+			t.Fatalf("zone file %s was not written: %v", name, err)
+		}
+		records := parseZoneFile(t, data)
+		assert.Equal(t, dns.TypeSOA, records[0].Header().Rrtype)
+	}
+
+	data, _ := os.ReadFile(filepath.Join(testOmada.config.export_zone_dir, "omada.home.zone"))
+	assert.Contains(t, string(data), "client-001.omada.home.\t60\tIN\tA\t10.0.0.101\n")
+	data, _ = os.ReadFile(filepath.Join(testOmada.config.export_zone_dir, "in-addr.arpa.zone"))
+	assert.Contains(t, string(data), "102.0.0.10.in-addr.arpa.\t60\tIN\tPTR\twin10-vm.omada.home.\n")
+}
+
+func TestRenderHosts(t *testing.T) {
+
+	zone := file.NewZone("omada.home.", "")
+	addSoaRecord(zone, "omada.home.")
+	zone.Insert(mustParseStaticRecord(t, "laptop.omada.home. 60 IN A 10.0.0.101"))
+	zone.Insert(mustParseStaticRecord(t, "laptop.omada.home. 60 IN AAAA 2001:db8::101"))
+	zone.Insert(mustParseStaticRecord(t, "desktop.omada.home. 60 IN A 10.0.0.102"))
+	zone.Insert(mustParseStaticRecord(t, "*.omada.home. 60 IN A 10.0.0.200"))
+	zone.Insert(mustParseStaticRecord(t, "www.omada.home. 60 IN CNAME laptop.omada.home."))
+	reverse := file.NewZone(ptrZone, "")
+	addSoaRecord(reverse, ptrZone)
+	reverse.Insert(mustParseStaticRecord(t, "101.0.0.10.in-addr.arpa. 60 IN PTR laptop.omada.home."))
+	reverse.Insert(mustParseStaticRecord(t, "102.0.0.10.in-addr.arpa. 60 IN PTR desktop.omada.home."))
+
+	addresses, ptrs := hostRecords(map[string]*file.Zone{"omada.home.": zone, ptrZone: reverse})
+	assert.Len(t, addresses, 3)
+	assert.Len(t, ptrs, 2)
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{"hosts", `# generated by the coredns omada plugin
+10.0.0.102	desktop.omada.home
+10.0.0.101	laptop.omada.home
+2001:db8::101	laptop.omada.home
+`},
+		{"dnsmasq", `# generated by the coredns omada plugin
+address=/desktop.omada.home/10.0.0.102
+address=/laptop.omada.home/10.0.0.101
+address=/laptop.omada.home/2001:db8::101
+ptr-record=101.0.0.10.in-addr.arpa,laptop.omada.home
+ptr-record=102.0.0.10.in-addr.arpa,desktop.omada.home
+`},
+		{"unbound", `# generated by the coredns omada plugin
+local-data: "desktop.omada.home.	60	IN	A	10.0.0.102"
+local-data: "laptop.omada.home.	60	IN	A	10.0.0.101"
+local-data: "laptop.omada.home.	60	IN	AAAA	2001:db8::101"
+local-data: "101.0.0.10.in-addr.arpa.	60	IN	PTR	laptop.omada.home."
+local-data: "102.0.0.10.in-addr.arpa.	60	IN	PTR	desktop.omada.home."
+`},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, string(renderHosts(test.format, addresses, ptrs)), test.format)
+	}
+}
+
+func TestUpdateExportsHosts(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateExportsHosts/NewOmada': %v", err)
+	}
+	dir := t.TempDir()
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.hosts_exports = []hostsExport{
+		{format: "hosts", path: filepath.Join(dir, "hosts")},
+		{format: "dnsmasq", path: filepath.Join(dir, "omada.conf")},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateExportsHosts/controllerInit': %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "hosts"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "10.0.0.102\twin10-vm.omada.home\n")
+	assert.NotContains(t, string(data), "kubernetes")
+
+	data, err = os.ReadFile(filepath.Join(dir, "omada.conf"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "address=/win10-vm.omada.home/10.0.0.102\n")
+	assert.Contains(t, string(data), "ptr-record=102.0.0.10.in-addr.arpa,win10-vm.omada.home\n")
+}
@@ -0,0 +1,399 @@
+package coredns_omada
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/miekg/dns"
+)
+
+// fallbackConfig is the wildcard fallback for a zone. Either targets or cname
+// is set, a wildcard can't be a CNAME and hold other records at the same time.
+type fallbackConfig struct {
+	targets []string // ip addresses, hostnames or fqdns the wildcard resolves to
+	cname   string   // target of a wildcard CNAME record
+}
+
+// enabled reports whether any fallback is configured
+func (f fallbackConfig) enabled() bool {
+	return len(f.targets) > 0 || f.cname != ""
+}
+
+// fallbackResolverTimeout is how long to wait for the fallback_resolver
+const fallbackResolverTimeout = 5 * time.Second
+
+var (
+	fallbackValidChars    = regexp.MustCompile(`^[a-zA-Z0-9.-]+$`)
+	fallbackConsecutive   = regexp.MustCompile(`\.\.`)
+	fallbackInvalidLabels = regexp.MustCompile(`(^|\.)-|-(\.|$)`)
+)
+
+// validateFallbackTarget checks a fallback target is an IPv4 or IPv6 address,
+// a hostname or an FQDN
+func validateFallbackTarget(target string) error {
+
+	// Basic validation: check reasonable length
+	if len(target) > 253 {
+		return fmt.Errorf("fallback too long (max 253 characters): %q", target)
+	}
+	if net.ParseIP(target) != nil {
+		return nil
+	}
+
+	// Check valid characters, no consecutive dots and each label doesn't start/end with hyphen
+	if !fallbackValidChars.MatchString(target) ||
+		fallbackConsecutive.MatchString(target) ||
+		fallbackInvalidLabels.MatchString(target) {
+		return fmt.Errorf("fallback contains invalid characters: %q", target)
+	}
+	return nil
+}
+
+// parseFallbackTargets validates the arguments of a fallback directive. A
+// single empty argument disables the fallback.
+func parseFallbackTargets(args []string) ([]string, error) {
+
+	if len(args) == 1 && args[0] == "" {
+		return nil, nil
+	}
+	for _, target := range args {
+		if err := validateFallbackTarget(target); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+// fallbackExclusions are names which get NXDOMAIN instead of the fallback
+type fallbackExclusions struct {
+	labels   []string         // matched against the leftmost label
+	patterns []*regexp.Regexp // matched against the name relative to the zone
+}
+
+// match reports whether a name relative to its zone, without a trailing dot,
+// is excluded from the fallback
+func (e fallbackExclusions) match(name string) bool {
+
+	label, _, _ := strings.Cut(name, ".")
+	for _, l := range e.labels {
+		if strings.EqualFold(l, label) {
+			return true
+		}
+	}
+	for _, p := range e.patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// fallbackExcluded reports whether a query in a zone which would otherwise be
+// answered by the fallback must get NXDOMAIN, because the name is excluded or
+// outside of the fallback_mode. Names which exist in the zone or are answered
+// by another wildcard are never excluded. Callers must hold zMu.
+func (o *Omada) fallbackExcluded(zone *file.Zone, zoneName string, qname string) bool {
+
+	if zoneName == ptrZone || strings.EqualFold(qname, zoneName) || !o.fallbackFor(zoneName).enabled() {
+		return false
+	}
+	if _, found := zone.Search(qname); found {
+		return false
+	}
+
+	// walk up to the zone apex to find what answers the query, the zone
+	// doesn't synthesize records below names which exist
+	for parent := parentName(qname); parent != "" && !strings.EqualFold(parent, zoneName); parent = parentName(parent) {
+		if _, found := zone.Search("*." + parent); found {
+			return false
+		}
+		if _, found := zone.Search(parent); found {
+			return o.config.fallback_mode == "single_label" || o.config.fallback_mode == "no_host_subdomains"
+		}
+	}
+
+	// strip the zone by its labels, the case of the query may differ
+	labels := dns.SplitDomainName(qname)
+	name := strings.Join(labels[:len(labels)-dns.CountLabel(zoneName)], ".")
+	if o.config.fallback_mode == "single_label" && strings.Contains(name, ".") {
+		return true
+	}
+	return o.config.fallback_exclude.match(name)
+}
+
+// parentName returns a name with its leftmost label removed
+func parentName(name string) string {
+	_, parent, _ := strings.Cut(name, ".")
+	return parent
+}
+
+// fallbackFor returns the fallback for a zone, a zone_fallback takes precedence
+// over the global fallback. Zone names are compared case-insensitively.
+func (o *Omada) fallbackFor(zone string) fallbackConfig {
+	if f, ok := o.config.zone_fallbacks[strings.ToLower(zone)]; ok {
+		return f
+	}
+	return o.config.fallback
+}
+
+// addFallbackRecords adds wildcard fallback records for unresolved queries in
+// each forward zone and returns the record types and records which were added.
+// Callers must hold uMu.
+func (o *Omada) addFallbackRecords(zones map[string]*file.Zone, records map[string]DnsRecords) (map[uint16]bool, []recordEntry) {
+
+	types := make(map[uint16]bool)
+	var entries []recordEntry
+	info := recordInfo{source: "fallback"}
+	static := staticNames(o.static)
+	for dnsDomain, zone := range zones {
+		if dnsDomain == ptrZone {
+			continue
+		}
+		fallback := o.fallbackFor(dnsDomain)
+		if !fallback.enabled() {
+			continue
+		}
+
+		wildcardName := fmt.Sprintf("*.%s", dnsDomain)
+		if static[wildcardName] {
+			log.Debugf("update: static wildcard record replaces fallback for zone: %s", dnsDomain)
+			continue
+		}
+		hdr := dns.RR_Header{Name: wildcardName, Class: dns.ClassINET, Ttl: 60}
+
+		// a CNAME fallback answers every type with the alias
+		if fallback.cname != "" {
+			hdr.Rrtype = dns.TypeCNAME
+			rr := &dns.CNAME{Hdr: hdr, Target: dns.Fqdn(fallback.cname)}
+			zone.Insert(rr)
+			entries = append(entries, recordEntry{zone: dnsDomain, rr: rr, recordInfo: info})
+			types[dns.TypeCNAME] = true
+			types[dns.TypeAAAA] = true
+			log.Debugf("update: added wildcard fallback record: %s -> %s", wildcardName, fallback.cname)
+			continue
+		}
+
+		for _, ip := range o.fallbackIPs(fallback.targets, dnsDomain, records) {
+			var rr dns.RR
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rr = &dns.A{Hdr: hdr, A: ip4}
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rr = &dns.AAAA{Hdr: hdr, AAAA: ip}
+				types[dns.TypeAAAA] = true
+			}
+			zone.Insert(rr)
+			entries = append(entries, recordEntry{zone: dnsDomain, rr: rr, recordInfo: info})
+			log.Debugf("update: added wildcard fallback record: %s -> %s", wildcardName, ip)
+		}
+	}
+	return types, entries
+}
+
+// fallbackIPs returns the addresses of the fallback targets for a zone.
+// Hostnames are qualified with the zone, hostnames and FQDNs must resolve
+// within the managed zones.
+func (o *Omada) fallbackIPs(targets []string, dnsDomain string, records map[string]DnsRecords) []net.IP {
+
+	var ips []net.IP
+	for _, target := range targets {
+
+		// Case 1: fallback is an IP address
+		if ip := net.ParseIP(target); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+
+		// Case 2 & 3: fallback is FQDN or hostname
+		var targetFQDN string
+		if strings.Contains(target, ".") {
+			// Case 2: FQDN - use as-is
+			targetFQDN = strings.ToLower(dns.Fqdn(target))
+		} else {
+			// Case 3: hostname - append current zone
+			targetFQDN = strings.ToLower(fmt.Sprintf("%s.%s", target, dnsDomain))
+		}
+
+		log.Debugf("update: looking for fallback FQDN: %s", targetFQDN)
+		resolved := o.resolveInZones(targetFQDN, records)
+		if len(resolved) == 0 {
+			resolved = o.fallbackAddrs[targetFQDN]
+		}
+		if len(resolved) == 0 {
+			log.Warningf("update: fallback '%s' not found in any zone, skipping it for zone %s", target, dnsDomain)
+			continue
+		}
+		ips = append(ips, resolved...)
+	}
+	return ips
+}
+
+// resolveInZones returns the addresses of an FQDN from the static, dynamic and
+// controller records, in that order of precedence
+func (o *Omada) resolveInZones(targetFQDN string, records map[string]DnsRecords) []net.IP {
+
+	var ips []net.IP
+	for _, rr := range o.static {
+		if !strings.EqualFold(rr.Header().Name, targetFQDN) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	if len(ips) > 0 {
+		return ips
+	}
+
+	for _, domainRecords := range o.updates {
+		if aRecord, ok := domainRecords.ARecords[targetFQDN]; ok {
+			return []net.IP{aRecord.record.A}
+		}
+	}
+	for _, domainRecords := range records {
+		if aRecord, ok := domainRecords.ARecords[targetFQDN]; ok {
+			return []net.IP{aRecord.record.A}
+		}
+	}
+	return nil
+}
+
+// fallbackLookups are the results of looking up the fallback targets outside
+// of the managed zones
+type fallbackLookups struct {
+	resolved map[string][]net.IP
+	failed   map[string]error
+}
+
+// resolveExternalFallbacks looks up every FQDN fallback target with the
+// fallback_resolver, except targets in the zones from the last refresh. The
+// lookups run concurrently and callers must not hold uMu, so a slow resolver
+// doesn't hold up dynamic updates.
+func (o *Omada) resolveExternalFallbacks() (lookups fallbackLookups) {
+
+	if o.config.fallback_resolver == "" {
+		return lookups
+	}
+
+	o.zMu.RLock()
+	zoneNames := o.zoneNames
+	o.zMu.RUnlock()
+
+	targets := make(map[string]bool)
+	fallbacks := []fallbackConfig{o.config.fallback}
+	for _, f := range o.config.zone_fallbacks {
+		fallbacks = append(fallbacks, f)
+	}
+	for _, f := range fallbacks {
+		for _, target := range f.targets {
+			if net.ParseIP(target) != nil || !strings.Contains(target, ".") {
+				continue
+			}
+			targetFQDN := strings.ToLower(dns.Fqdn(target))
+			if plugin.Zones(zoneNames).Matches(targetFQDN) == "" {
+				targets[targetFQDN] = true
+			}
+		}
+	}
+
+	lookups.resolved = make(map[string][]net.IP)
+	lookups.failed = make(map[string]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for targetFQDN := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips, err := lookupFallbackTarget(o.config.fallback_resolver, targetFQDN)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				lookups.failed[targetFQDN] = err
+				return
+			}
+			lookups.resolved[targetFQDN] = ips
+		}()
+	}
+	wg.Wait()
+	return lookups
+}
+
+// storeExternalFallbacks keeps the addresses of the fallback targets outside
+// of the managed zones. A target which couldn't be resolved keeps the
+// addresses from its last successful lookup. Callers must hold uMu.
+func (o *Omada) storeExternalFallbacks(lookups fallbackLookups, zoneNames []string) {
+
+	if o.fallbackAddrs == nil {
+		o.fallbackAddrs = make(map[string][]net.IP)
+	}
+	zones := plugin.Zones(zoneNames)
+	for targetFQDN, ips := range lookups.resolved {
+		if zones.Matches(targetFQDN) != "" {
+			continue
+		}
+		log.Debugf("update: resolved fallback %s to %v", targetFQDN, ips)
+		o.fallbackAddrs[targetFQDN] = ips
+	}
+	for targetFQDN, err := range lookups.failed {
+		if zones.Matches(targetFQDN) != "" {
+			continue
+		}
+		if _, ok := o.fallbackAddrs[targetFQDN]; ok {
+			log.Warningf("update: failed to resolve fallback %s, keeping last good address: %v", targetFQDN, err)
+		} else {
+			log.Warningf("update: failed to resolve fallback %s: %v", targetFQDN, err)
+		}
+	}
+}
+
+// lookupFallbackTarget returns the IPv4 and IPv6 addresses of an FQDN from an
+// upstream resolver. Each address type is looked up on its own, so it only
+// fails when neither lookup returns an address.
+func lookupFallbackTarget(resolver string, fqdn string) ([]net.IP, error) {
+
+	client := &dns.Client{Timeout: fallbackResolverTimeout}
+	var ips []net.IP
+	var errs []error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := new(dns.Msg)
+		m.SetQuestion(fqdn, qtype)
+		r, _, err := client.Exchange(m, resolver)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			errs = append(errs, fmt.Errorf("%s returned %s for %s", resolver, dns.RcodeToString[r.Rcode], dns.TypeToString[qtype]))
+			continue
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A)
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		if len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+		return nil, fmt.Errorf("%s returned no addresses", resolver)
+	}
+	for _, err := range errs {
+		log.Debugf("update: partial lookup of fallback target %s: %v", fqdn, err)
+	}
+	return ips, nil
+}
@@ -0,0 +1,587 @@
+package coredns_omada
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateFallbackTarget(t *testing.T) {
+
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{"192.168.1.100", false},
+		{"2001:db8::1", false},
+		{"caddy", false},
+		{"caddy.omada.home", false},
+		{"caddy.omada.home.", false},
+		{"invalid@domain", true},
+		{"api.-server.example.com", true},
+		{"double..dot", true},
+	}
+
+	for i, test := range tests {
+		err := validateFallbackTarget(test.target)
+		if test.wantErr && err == nil {
+			t.Errorf("Test %d: Expected error for %q but got none", i, test.target)
+		}
+		if !test.wantErr && err != nil {
+			t.Errorf("Test %d: Expected no error for %q but got: %v", i, test.target, err)
+		}
+	}
+}
+
+func TestUpdateWithZoneFallback(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithZoneFallback/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.fallback = fallbackConfig{cname: "proxy.example.com"}
+	testOmada.config.zone_fallbacks = map[string]fallbackConfig{
+		"omada.work.": {targets: []string{"10.0.0.200", "client-001.omada.home", "2001:db8::1"}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithZoneFallback/controllerInit': %v", err)
+	}
+
+	tests := []testCases{
+		{ // existing record should work normally
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+		{ // global fallback is a cname
+			qname:      "app.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"app.omada.home.	60	IN	CNAME	proxy.example.com."},
+		},
+		{ // cname fallback also answers AAAA queries
+			qname:      "app.omada.home.",
+			qtype:      dns.TypeAAAA,
+			wantAnswer: []string{"app.omada.home.	60	IN	CNAME	proxy.example.com."},
+		},
+		{ // zone fallback with multiple addresses
+			qname: "app.omada.work.",
+			qtype: dns.TypeA,
+			wantAnswer: []string{
+				"app.omada.work.	60	IN	A	10.0.0.200",
+				"app.omada.work.	60	IN	A	10.0.0.101",
+			},
+		},
+		{ // zone fallback with an IPv6 address
+			qname:      "app.omada.work.",
+			qtype:      dns.TypeAAAA,
+			wantAnswer: []string{"app.omada.work.	60	IN	AAAA	2001:db8::1"},
+		},
+		{ // other types are still passed to the next plugin
+			qname:        "app.omada.work.",
+			qtype:        dns.TypeMX,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+}
+
+func TestFallbackFor(t *testing.T) {
+
+	o := &Omada{}
+	o.config.fallback = fallbackConfig{cname: "proxy.example.com"}
+	o.config.zone_fallbacks = map[string]fallbackConfig{
+		"omada.work.": {targets: []string{"10.0.0.200"}},
+	}
+
+	tests := []struct {
+		zone      string
+		wantCname string
+	}{
+		{"omada.work.", ""},
+		{"Omada.Work.", ""},
+		{"omada.home.", "proxy.example.com"},
+	}
+
+	for i, test := range tests {
+		if got := o.fallbackFor(test.zone); got.cname != test.wantCname {
+			t.Errorf("Test %d: Expected fallbackFor(%q) to have cname %q, got %q", i, test.zone, test.wantCname, got.cname)
+		}
+	}
+}
+
+func TestFallbackExclusions(t *testing.T) {
+
+	exclusions := fallbackExclusions{
+		labels:   []string{"wpad", "_dmarc"},
+		patterns: []*regexp.Regexp{regexp.MustCompile(`^isatap`)},
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"wpad", true},
+		{"WPAD", true},
+		{"_dmarc.mail", true},
+		{"isatap", true},
+		{"isatap2", true},
+		{"app", false},
+		{"mail._dmarc", false},
+		{"my-wpad", false},
+	}
+
+	for i, test := range tests {
+		if got := exclusions.match(test.name); got != test.want {
+			t.Errorf("Test %d: Expected match(%q) to be %v, got %v", i, test.name, test.want, got)
+		}
+	}
+}
+
+func TestUpdateWithFallbackExclusions(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithFallbackExclusions/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.fallback = fallbackConfig{targets: []string{"10.0.0.200"}}
+	testOmada.config.zone_fallbacks = map[string]fallbackConfig{"omada.work.": {}}
+	testOmada.config.fallback_exclude = fallbackExclusions{
+		labels:   []string{"wpad", "client-001"},
+		patterns: []*regexp.Regexp{regexp.MustCompile(`^isatap`)},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithFallbackExclusions/controllerInit': %v", err)
+	}
+
+	soa := "omada.home.	300	IN	SOA	ns.omada.home. hostmaster.omada.home. 1 7200 3600 86400 300"
+	tests := []testCases{
+		{ // excluded label gets NXDOMAIN
+			qname:        "wpad.omada.home.",
+			qtype:        dns.TypeA,
+			wantMsgRCode: dns.RcodeNameError,
+			wantNS:       []string{soa},
+		},
+		{ // excluded pattern gets NXDOMAIN
+			qname:        "isatap.omada.home.",
+			qtype:        dns.TypeA,
+			wantMsgRCode: dns.RcodeNameError,
+			wantNS:       []string{soa},
+		},
+		{ // names which exist are still answered
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+		{ // other names use the fallback
+			qname:      "app.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"app.omada.home.	60	IN	A	10.0.0.200"},
+		},
+		{ // zones without a fallback are not affected
+			qname:        "wpad.omada.work.",
+			qtype:        dns.TypeA,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+}
+
+func TestUpdateWithFallbackMode(t *testing.T) {
+
+	tests := []struct {
+		mode  string
+		cases []testCases
+	}{
+		{"all", []testCases{
+			{ // names below unknown names use the fallback
+				qname:      "foo.app.omada.home.",
+				qtype:      dns.TypeA,
+				wantAnswer: []string{"foo.app.omada.home.	60	IN	A	10.0.0.200"},
+			},
+			{ // names below hosts are passed to the next plugin
+				qname:        "foo.client-001.omada.home.",
+				qtype:        dns.TypeA,
+				wantRetCode:  dns.RcodeServerFailure,
+				wantMsgRCode: dns.RcodeServerFailure,
+			},
+		}},
+		{"single_label", []testCases{
+			{ // single labels use the fallback
+				qname:      "app.omada.home.",
+				qtype:      dns.TypeA,
+				wantAnswer: []string{"app.omada.home.	60	IN	A	10.0.0.200"},
+			},
+			{ // deeper names get NXDOMAIN
+				qname:        "foo.app.omada.home.",
+				qtype:        dns.TypeA,
+				wantMsgRCode: dns.RcodeNameError,
+				wantNS:       []string{"omada.home.	300	IN	SOA	ns.omada.home. hostmaster.omada.home. 1 7200 3600 86400 300"},
+			},
+			{ // names below hosts get NXDOMAIN
+				qname:        "foo.client-001.omada.home.",
+				qtype:        dns.TypeA,
+				wantMsgRCode: dns.RcodeNameError,
+				wantNS:       []string{"omada.home.	300	IN	SOA	ns.omada.home. hostmaster.omada.home. 1 7200 3600 86400 300"},
+			},
+			{ // other wildcards are still answered
+				qname:      "test.kubernetes.omada.home.",
+				qtype:      dns.TypeA,
+				wantAnswer: []string{"test.kubernetes.omada.home.	60	IN	A	10.0.0.150"},
+			},
+		}},
+		{"no_host_subdomains", []testCases{
+			{ // names below unknown names use the fallback
+				qname:      "foo.app.omada.home.",
+				qtype:      dns.TypeA,
+				wantAnswer: []string{"foo.app.omada.home.	60	IN	A	10.0.0.200"},
+			},
+			{ // names below hosts get NXDOMAIN
+				qname:        "foo.client-001.omada.home.",
+				qtype:        dns.TypeA,
+				wantMsgRCode: dns.RcodeNameError,
+				wantNS:       []string{"omada.home.	300	IN	SOA	ns.omada.home. hostmaster.omada.home. 1 7200 3600 86400 300"},
+			},
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			testServer := setupTestServer()
+			defer testServer.Close()
+
+			testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+			if err != nil {
+				t.Fatalf("test failure on 'TestUpdateWithFallbackMode/NewOmada': %v", err)
+			}
+			testOmada.Next = testHandler()
+			testOmada.config.refresh = time.Minute
+			testOmada.config.login_refresh = 24 * time.Hour
+			testOmada.config.resolve_clients = true
+			testOmada.config.resolve_devices = true
+			testOmada.config.resolve_dhcp_reservations = true
+			testOmada.config.stale_record_duration = 5 * time.Minute
+			testOmada.config.fallback = fallbackConfig{targets: []string{"10.0.0.200"}}
+			testOmada.config.fallback_mode = test.mode
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err = testOmada.controllerInit(ctx)
+			if err != nil {
+				t.Fatalf("test failure on 'TestUpdateWithFallbackMode/controllerInit': %v", err)
+			}
+
+			executeTestCases(t, testOmada, test.cases)
+		})
+	}
+}
+
+func TestUpdateWithMixedCaseDomain(t *testing.T) {
+
+	// the controller reports the network domain with upper case letters
+	handler := testControllerHandler(func(path string) bool { return false })
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/setting/lan/networks") {
+			handler(w, r)
+			return
+		}
+		response, err := os.ReadFile("./test-data/networks-response.json")
+		if err != nil {
+			log.Fatal(err)
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(bytes.ReplaceAll(response, []byte(`"omada.home"`), []byte(`"Omada.Home"`)))
+	}))
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithMixedCaseDomain/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.fallback = fallbackConfig{targets: []string{"10.0.0.200"}}
+	testOmada.config.fallback_mode = "single_label"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithMixedCaseDomain/controllerInit': %v", err)
+	}
+
+	assert.Contains(t, testOmada.zoneNames, "omada.home.")
+
+	tests := []testCases{
+		{
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+		{
+			qname:      "app.Omada.Home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"app.omada.home.	60	IN	A	10.0.0.200"},
+		},
+		{
+			qname:        "foo.app.omada.home.",
+			qtype:        dns.TypeA,
+			wantMsgRCode: dns.RcodeNameError,
+			wantNS:       []string{"omada.home.	300	IN	SOA	ns.omada.home. hostmaster.omada.home. 1 7200 3600 86400 300"},
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+}
+
+func TestFallbackExcludedMixedCaseZone(t *testing.T) {
+
+	o := &Omada{}
+	o.config.fallback = fallbackConfig{targets: []string{"10.0.0.200"}}
+	o.config.fallback_mode = "single_label"
+	o.config.fallback_exclude = fallbackExclusions{labels: []string{"wpad"}}
+	zone := file.NewZone("Omada.Home.", "")
+
+	tests := []struct {
+		qname string
+		want  bool
+	}{
+		{"app.omada.home.", false},
+		{"foo.app.omada.home.", true},
+		{"wpad.omada.home.", true},
+		{"WPAD.Omada.Home.", true},
+	}
+
+	for i, test := range tests {
+		// the walk up to the zone apex must end even though the case differs
+		done := make(chan bool)
+		go func() {
+			done <- o.fallbackExcluded(zone, "Omada.Home.", test.qname)
+		}()
+		select {
+		case excluded := <-done:
+			if excluded != test.want {
+				t.Errorf("Test %d: Expected fallbackExcluded(%q) to be %v, got %v", i, test.qname, test.want, excluded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Test %d: fallbackExcluded(%q) did not return", i, test.qname)
+		}
+	}
+}
+
+// setupTestResolver starts a dns server answering for proxy.example.com and
+// the A records of v4only.example.com, or with SERVFAIL while fail is set
+func setupTestResolver(t *testing.T, fail *atomic.Bool) string {
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) }}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		switch {
+		case fail.Load():
+			m.Rcode = dns.RcodeServerFailure
+		case q.Name == "v4only.example.com." && q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A: net.ParseIP("203.0.113.20")})
+		case q.Name == "v4only.example.com.":
+			m.Rcode = dns.RcodeServerFailure
+		case q.Name != "proxy.example.com.":
+			m.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A: net.ParseIP("203.0.113.10")})
+		case q.Qtype == dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				AAAA: net.ParseIP("2001:db8::10")})
+		}
+		w.WriteMsg(m)
+	})
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestLookupFallbackTarget(t *testing.T) {
+
+	var fail atomic.Bool
+	resolver := setupTestResolver(t, &fail)
+
+	ips, err := lookupFallbackTarget(resolver, "proxy.example.com.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 2 || ips[0].String() != "203.0.113.10" || ips[1].String() != "2001:db8::10" {
+		t.Errorf("unexpected addresses: %v", ips)
+	}
+
+	// a failing AAAA lookup keeps the A answers
+	ips, err = lookupFallbackTarget(resolver, "v4only.example.com.")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips) != 1 || ips[0].String() != "203.0.113.20" {
+		t.Errorf("unexpected addresses: %v", ips)
+	}
+
+	if _, err := lookupFallbackTarget(resolver, "unknown.example.com."); err == nil {
+		t.Errorf("expected error for unknown name")
+	}
+
+	fail.Store(true)
+	if _, err := lookupFallbackTarget(resolver, "proxy.example.com."); err == nil {
+		t.Errorf("expected error for failing resolver")
+	}
+}
+
+func TestUpdateWithExternalFallback(t *testing.T) {
+
+	var fail atomic.Bool
+	resolver := setupTestResolver(t, &fail)
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithExternalFallback/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.fallback = fallbackConfig{targets: []string{"proxy.example.com"}}
+	testOmada.config.fallback_resolver = resolver
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithExternalFallback/controllerInit': %v", err)
+	}
+
+	tests := []testCases{
+		{
+			qname:      "app.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"app.omada.home.	60	IN	A	203.0.113.10"},
+		},
+		{
+			qname:      "app.omada.home.",
+			qtype:      dns.TypeAAAA,
+			wantAnswer: []string{"app.omada.home.	60	IN	AAAA	2001:db8::10"},
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+
+	// the last good addresses are kept when the resolver fails
+	fail.Store(true)
+	err = testOmada.updateZones()
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithExternalFallback/updateZones': %v", err)
+	}
+	executeTestCases(t, testOmada, tests)
+}
+
+func TestUpdateWithSlowExternalFallback(t *testing.T) {
+
+	// the resolver doesn't answer until it is released
+	queried := make(chan struct{}, 2)
+	release := make(chan struct{})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := &dns.Server{PacketConn: pc}
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		queried <- struct{}{}
+		<-release
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		w.WriteMsg(m)
+	})
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	o := testDynamicOmada()
+	o.config.fallback = fallbackConfig{targets: []string{"proxy.example.com"}}
+	o.config.fallback_resolver = pc.LocalAddr().String()
+
+	done := make(chan error)
+	go func() { done <- o.updateZones() }()
+	<-queried
+
+	// dynamic updates are handled while the refresh waits for the resolver
+	updated := make(chan int)
+	go func() {
+		updated <- sendUpdate(t, o, "update-key.", []dns.RR{test.A("vm1.omada.test. 120 IN A 192.168.0.150")}, nil)
+	}()
+	select {
+	case rcode := <-updated:
+		if rcode != dns.RcodeSuccess {
+			t.Errorf("unexpected rcode for dynamic update: %s", dns.RcodeToString[rcode])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("dynamic update blocked by the fallback lookup")
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("test failure on 'TestUpdateWithSlowExternalFallback/updateZones': %v", err)
+	}
+}
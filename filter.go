@@ -0,0 +1,122 @@
+package coredns_omada
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	omada "github.com/dougbw/go-omada"
+)
+
+// fields which filter rules can match for each source
+var (
+	clientFilterFields      = []string{"network", "vlan", "ssid", "wireless", "guest", "tag"}
+	deviceFilterFields      = []string{"network", "vlan"}
+	reservationFilterFields = []string{"network", "vlan"}
+)
+
+// filterRule matches entries whose field equals any of the values
+type filterRule struct {
+	field  string
+	values []string
+}
+
+// recordFilter decides which entries from a source are published. An entry
+// must match at least one include rule (if there are any) and no exclude rule.
+type recordFilter struct {
+	include []filterRule
+	exclude []filterRule
+}
+
+// filterAttributes are the field values of a single entry that rules match
+// against. A field can have several values, e.g. the tags of a client.
+type filterAttributes map[string][]string
+
+// addRule parses the arguments of a filter directive: include|exclude <field> <values...>
+func (f *recordFilter) addRule(args []string, fields []string) error {
+
+	if len(args) < 3 {
+		return fmt.Errorf("expected: include|exclude <field> <value> [<value>...]")
+	}
+
+	field := args[1]
+	if !slices.Contains(fields, field) {
+		return fmt.Errorf("unknown filter field %q, must be one of: %s", field, strings.Join(fields, ", "))
+	}
+	rule := filterRule{field: field}
+	for _, v := range args[2:] {
+		if field == "wireless" || field == "guest" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid value for filter field %q: %q", field, v)
+			}
+			v = strconv.FormatBool(b)
+		}
+		rule.values = append(rule.values, v)
+	}
+
+	switch args[0] {
+	case "include":
+		f.include = append(f.include, rule)
+	case "exclude":
+		f.exclude = append(f.exclude, rule)
+	default:
+		return fmt.Errorf("filter action must be 'include' or 'exclude': %q", args[0])
+	}
+	return nil
+}
+
+// match reports whether an entry with the given attributes should be published
+func (f recordFilter) match(attrs filterAttributes) bool {
+
+	for _, rule := range f.exclude {
+		if rule.match(attrs) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, rule := range f.include {
+		if rule.match(attrs) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r filterRule) match(attrs filterAttributes) bool {
+	for _, value := range attrs[r.field] {
+		for _, v := range r.values {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// networkAttributes returns the filter attributes shared by every source, based
+// on the network an entry's address belongs to
+func networkAttributes(network omada.OmadaNetwork) filterAttributes {
+	return filterAttributes{
+		"network": {network.Name},
+		"vlan":    {strconv.Itoa(network.Vlan)},
+	}
+}
+
+// clientAttributes returns the filter attributes for a client. The vlan is the
+// client's own VLAN id, falling back to the network's when the controller
+// doesn't report one.
+func clientAttributes(network omada.OmadaNetwork, client omada.Client) filterAttributes {
+	attrs := networkAttributes(network)
+	if client.Vid != 0 {
+		attrs["vlan"] = []string{strconv.Itoa(client.Vid)}
+	}
+	attrs["ssid"] = []string{client.Ssid}
+	attrs["wireless"] = []string{strconv.FormatBool(client.Wireless)}
+	attrs["guest"] = []string{strconv.FormatBool(client.Guest)}
+	attrs["tag"] = client.TagIds
+	return attrs
+}
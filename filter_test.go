@@ -0,0 +1,102 @@
+package coredns_omada
+
+import (
+	"testing"
+
+	omada "github.com/dougbw/go-omada"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordFilter(t *testing.T) {
+
+	lan := omada.OmadaNetwork{Name: "LAN", Vlan: 1}
+	iot := omada.OmadaNetwork{Name: "IoT", Vlan: 30}
+	laptop := omada.Client{Name: "laptop", Ssid: "Home", Wireless: true}
+	guest := omada.Client{Name: "phone", Ssid: "Guest-WiFi", Wireless: true, Guest: true}
+	desktop := omada.Client{Name: "desktop"}
+	camera := omada.Client{Name: "camera", Vid: 30, TagIds: []string{"5f1c2a", "6a9e0d"}}
+
+	tests := []struct {
+		rules    [][]string
+		network  omada.OmadaNetwork
+		client   omada.Client
+		expected bool
+	}{
+		{ // no rules
+			network:  lan,
+			client:   laptop,
+			expected: true,
+		},
+		{ // excluded ssid
+			rules:    [][]string{{"exclude", "ssid", "Guest-WiFi"}},
+			network:  lan,
+			client:   guest,
+			expected: false,
+		},
+		{ // excluded guest flag
+			rules:    [][]string{{"exclude", "guest", "true"}},
+			network:  lan,
+			client:   guest,
+			expected: false,
+		},
+		{ // excluded vlan
+			rules:    [][]string{{"exclude", "vlan", "20", "30"}},
+			network:  iot,
+			client:   desktop,
+			expected: false,
+		},
+		{ // excluded vlan of the client rather than its network
+			rules:    [][]string{{"exclude", "vlan", "30"}},
+			network:  lan,
+			client:   camera,
+			expected: false,
+		},
+		{ // excluded tag
+			rules:    [][]string{{"exclude", "tag", "6a9e0d"}},
+			network:  lan,
+			client:   camera,
+			expected: false,
+		},
+		{ // included tag
+			rules:    [][]string{{"include", "tag", "5f1c2a"}},
+			network:  lan,
+			client:   desktop,
+			expected: false,
+		},
+		{ // included network, case insensitive
+			rules:    [][]string{{"include", "network", "lan"}},
+			network:  lan,
+			client:   desktop,
+			expected: true,
+		},
+		{ // not included network
+			rules:    [][]string{{"include", "network", "LAN"}},
+			network:  iot,
+			client:   desktop,
+			expected: false,
+		},
+		{ // exclude takes precedence over include
+			rules:    [][]string{{"include", "network", "LAN"}, {"exclude", "wireless", "true"}},
+			network:  lan,
+			client:   laptop,
+			expected: false,
+		},
+	}
+
+	for i, test := range tests {
+		var filter recordFilter
+		for _, rule := range test.rules {
+			assert.NoError(t, filter.addRule(rule, clientFilterFields), "test %d", i)
+		}
+		assert.Equal(t, test.expected, filter.match(clientAttributes(test.network, test.client)), "test %d", i)
+	}
+}
+
+func TestRecordFilterInvalidRules(t *testing.T) {
+
+	var filter recordFilter
+	assert.Error(t, filter.addRule([]string{"exclude", "ssid"}, clientFilterFields))
+	assert.Error(t, filter.addRule([]string{"drop", "ssid", "Guest"}, clientFilterFields))
+	assert.Error(t, filter.addRule([]string{"exclude", "ssid", "Guest"}, deviceFilterFields))
+	assert.Error(t, filter.addRule([]string{"exclude", "guest", "maybe"}, clientFilterFields))
+}
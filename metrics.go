@@ -0,0 +1,25 @@
+package coredns_omada
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// refreshErrorCount counts failed controller API calls per site and data source.
+	refreshErrorCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "omada",
+		Name:      "refresh_errors_total",
+		Help:      "Counter of controller API errors during zone refresh, per site and data source.",
+	}, []string{"site", "source"})
+
+	// sourceUp reports whether the last fetch of a data source for a site succeeded.
+	sourceUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "omada",
+		Name:      "source_up",
+		Help:      "Whether the last fetch of a data source for a site succeeded (1) or failed (0).",
+	}, []string{"site", "source"})
+)
@@ -2,7 +2,9 @@ package coredns_omada
 
 import (
 	"context"
+	"net"
 	"sync"
+	"sync/atomic"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/file"
@@ -14,14 +16,31 @@ import (
 
 // Omada is the core struct of the omada plugin.
 type Omada struct {
-	config     config
-	controller omada.Controller
-	sites      []string
-	zoneNames  []string
-	zones      map[string]*file.Zone
-	zMu        sync.RWMutex
-	records    map[string]DnsRecords
-	Next       plugin.Handler
+	config          config
+	controller      omada.Controller
+	cMu             sync.RWMutex
+	api             *controllerAPI
+	sites           []string
+	zoneNames       []string
+	zones           map[string]*file.Zone
+	zMu             sync.RWMutex
+	records         map[string]DnsRecords
+	siteCache       map[string]siteData
+	updates         map[string]DnsRecords
+	static          []dns.RR
+	zoneFileRecords map[string][]dns.RR
+	servedTypes     map[uint16]bool
+	fallbackAddrs   map[string][]net.IP
+	entries         []recordEntry
+	built           bool
+	status          refreshStatus
+	refreshRequests chan struct{}
+	uMu             sync.Mutex
+	health          controllerHealth
+	webhook         *webhookSink
+	events          *eventLog
+	tracePlugin     atomic.Value // trace.Trace
+	Next            plugin.Handler
 }
 
 func NewOmada(ctx context.Context, url string, u string, p string) (*Omada, error) {
@@ -30,24 +49,34 @@ func NewOmada(ctx context.Context, url string, u string, p string) (*Omada, erro
 
 	zones := make(map[string]*file.Zone)
 	records := make(map[string]DnsRecords)
-
-	return &Omada{
-		controller: omada,
-		zones:      zones,
-		records:    records,
-	}, nil
+	siteCache := make(map[string]siteData)
+
+	o := &Omada{
+		controller:      omada,
+		zones:           zones,
+		records:         records,
+		siteCache:       siteCache,
+		refreshRequests: make(chan struct{}, 1),
+	}
+	// the config is only set after the plugin is created
+	o.api = newControllerAPI(url, func() (string, string, error) { return o.config.credentials() })
+	return o, nil
 }
 
 const ptrZone string = "in-addr.arpa."
 
 // ServeDNS implements the plugin.Handler interface.
 func (o *Omada) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	if r.Opcode == dns.OpcodeUpdate {
+		return o.serveUpdate(ctx, w, r)
+	}
+
 	state := request.Request{W: w, Req: r}
 	qname := state.Name()
 	qtype := state.QType()
 	log.Debugf("query; type: %d, name: %s\n", qtype, qname)
 
-	// this plugin can only handle 'A' and 'PTR' queries
+	// this plugin handles 'A', 'SOA' and 'PTR' queries, and the types of any static or fallback records
 	var qzone string
 	switch qtype {
 	case 1: // A
@@ -57,7 +86,15 @@ func (o *Omada) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	case 12: // PTR
 		qzone = ptrZone
 	default:
-		return plugin.NextOrFailure(o.Name(), o.Next, ctx, w, r)
+		// other types are only served when there are static or fallback records of that type
+		o.zMu.RLock()
+		served := o.servedTypes[qtype]
+		o.zMu.RUnlock()
+		if !served {
+			o.queryDecision(ctx, qname, qtype, "", "unsupported_type", 0)
+			return plugin.NextOrFailure(o.Name(), o.Next, ctx, w, r)
+		}
+		qzone = qname
 	}
 
 	// check zone
@@ -65,6 +102,7 @@ func (o *Omada) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	zoneName := plugin.Zones(o.zoneNames).Matches(qzone)
 	if zoneName == "" {
 		log.Debugf("-- ❌ query is not in managed zones: %s\n", qname)
+		o.queryDecision(ctx, qname, qtype, "", "unmanaged_zone", 0)
 		return plugin.NextOrFailure(o.Name(), o.Next, ctx, w, r)
 	}
 	log.Debugf("-- ✅ zone name: %s\n", zoneName)
@@ -74,29 +112,52 @@ func (o *Omada) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	m.Authoritative = true
 	var result file.Result
 
-	// lookup record in zones
+	// lookup record in zones, names excluded from the fallback don't exist
 	o.zMu.RLock()
-	m.Answer, m.Ns, m.Extra, result = o.zones[zoneName].Lookup(ctx, state, qname)
+	zone := o.zones[zoneName]
+	if o.fallbackExcluded(zone, zoneName, qname) {
+		m.Ns = []dns.RR{zone.SOA}
+		o.zMu.RUnlock()
+		log.Debugf("-- ❌ name is excluded from the fallback: %s\n", qname)
+		o.queryDecision(ctx, qname, qtype, zoneName, "excluded", 0)
+		m.Rcode = dns.RcodeNameError
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	}
+	m.Answer, m.Ns, m.Extra, result = zone.Lookup(ctx, state, qname)
 	o.zMu.RUnlock()
 
 	// no answer
 	if len(m.Answer) == 0 && result != file.NoData {
 		log.Debugf("-- ❌ answer len: %d, result: %v\n", len(m.Answer), result)
+		o.queryDecision(ctx, qname, qtype, zoneName, "no_answer", 0)
 		return plugin.NextOrFailure(o.Name(), o.Next, ctx, w, r)
 	}
 	log.Debugf("-- ✅ answer len: %d, result: %v\n", len(m.Answer), result)
 
+	decision := "answer"
 	switch result {
 	case file.Success:
 	case file.NoData:
+		decision = "nodata"
 	case file.NameError:
 		m.Rcode = dns.RcodeNameError
+		decision = "nxdomain"
 	case file.Delegation:
 		m.Authoritative = false
+		decision = "delegation"
 	case file.ServerFailure:
-		log.Debugf("RcodeServerFailure")
-		return dns.RcodeServerFailure, nil
+		// a CNAME to an external name which couldn't be resolved is still
+		// answered with the alias, the client can resolve the target itself
+		if len(m.Answer) == 0 || m.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			log.Debugf("RcodeServerFailure")
+			o.queryDecision(ctx, qname, qtype, zoneName, "servfail", 0)
+			return dns.RcodeServerFailure, nil
+		}
+		log.Debugf("-- ❌ failed to resolve external CNAME target, answering with the alias only")
+		decision = "cname_alias"
 	}
+	o.queryDecision(ctx, qname, qtype, zoneName, decision, len(m.Answer))
 
 	w.WriteMsg(m)
 	return dns.RcodeSuccess, nil
@@ -0,0 +1,45 @@
+package coredns_omada
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readSecretFile reads a credential from a file, such as a mounted kubernetes
+// secret. Trailing line breaks are removed as most tools add one.
+func readSecretFile(path string) (string, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", errors.New("file is empty")
+	}
+	return secret, nil
+}
+
+// credentials returns the controller username and password. Credentials from
+// username_file and password_file are read again on every call so rotated
+// secrets are picked up on the next login.
+func (c config) credentials() (username string, password string, err error) {
+
+	username = c.Username
+	if c.username_file != "" {
+		username, err = readSecretFile(c.username_file)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read username_file %s: %w", c.username_file, err)
+		}
+	}
+	password = c.Password
+	if c.password_file != "" {
+		password, err = readSecretFile(c.password_file)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read password_file %s: %w", c.password_file, err)
+		}
+	}
+	return username, password, nil
+}
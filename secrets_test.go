@@ -0,0 +1,73 @@
+package coredns_omada
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadSecretFile(t *testing.T) {
+
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "secret", "secret", false},
+		{"trailing newline", "secret\n", "secret", false},
+		{"windows newline", "secret\r\n", "secret", false},
+		{"spaces are kept", " secret ", " secret ", false},
+		{"empty", "", "", true},
+		{"only a newline", "\n", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "secret")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readSecretFile(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := readSecretFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestCredentialsRotation(t *testing.T) {
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	os.WriteFile(passwordFile, []byte("first\n"), 0o600)
+
+	c := config{Username: "viewer", Password: "first", password_file: passwordFile}
+	username, password, err := c.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "viewer", username)
+	assert.Equal(t, "first", password)
+
+	// a rotated secret is used without parsing the config again
+	os.WriteFile(passwordFile, []byte("second\n"), 0o600)
+	_, password, err = c.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, "second", password)
+
+	// login fails instead of using stale credentials when the file is gone
+	os.Remove(passwordFile)
+	_, _, err = c.credentials()
+	assert.ErrorContains(t, err, "password_file")
+
+	o := &Omada{config: c}
+	assert.ErrorContains(t, o.login(), "password_file")
+}
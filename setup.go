@@ -3,12 +3,13 @@ package coredns_omada
 import (
 	"context"
 	"errors"
-	"time"
+	"os"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/trace"
 )
 
 var log = clog.NewWithPlugin("omada")
@@ -25,6 +26,16 @@ func setup(c *caddy.Controller) error {
 	url := config.Controller_url
 	u := config.Username
 	p := config.Password
+
+	// the tls options are applied by a proxy the controller is reached through
+	if config.tls_config != nil {
+		url, err = startControllerProxy(ctx, url, config.tls_config)
+		if err != nil {
+			cancel()
+			return plugin.Error("omada", err)
+		}
+	}
+
 	o, err := NewOmada(ctx, url, u, p)
 	if err != nil {
 		cancel()
@@ -32,6 +43,15 @@ func setup(c *caddy.Controller) error {
 	}
 	o.config = config
 
+	o.events = newEventLog(os.Stdout, config)
+
+	// webhooks are delivered in the background for the lifetime of this instance
+	if len(config.webhooks) > 0 {
+		o.webhook = newWebhookSink(config)
+		o.health.notify = o.notifyHealth
+		go o.webhook.run(ctx)
+	}
+
 	if o.config.ignore_startup_errors {
 		go o.controllerInit(ctx)
 	} else {
@@ -42,6 +62,34 @@ func setup(c *caddy.Controller) error {
 		}
 	}
 
+	// register the dynamic update keys so the server verifies TSIG signatures
+	if len(config.update_keys) > 0 {
+		serverConfig := dnsserver.GetConfig(c)
+		if serverConfig.TsigSecret == nil {
+			serverConfig.TsigSecret = make(map[string]string)
+		}
+		for name, secret := range config.update_keys {
+			serverConfig.TsigSecret[name] = secret
+		}
+	}
+
+	// the admin api is closed on reload so the new instance can listen on the same address
+	if config.admin_listen != "" {
+		admin := &adminServer{addr: config.admin_listen, handler: o.adminHandler()}
+		c.OnStartup(admin.start)
+		c.OnRestart(admin.stop)
+		c.OnRestartFailed(admin.start)
+		c.OnFinalShutdown(admin.stop)
+	}
+
+	// refreshes are traced when the trace plugin is used in the same server block
+	c.OnStartup(func() error {
+		if t, ok := dnsserver.GetConfig(c).Handler("trace").(trace.Trace); ok {
+			o.setTracePlugin(t)
+		}
+		return nil
+	})
+
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
 		o.Next = next
 		return o
@@ -55,10 +103,14 @@ func setup(c *caddy.Controller) error {
 func (o *Omada) login() error {
 
 	log.Info("logging in...")
-	u := o.config.Username
-	p := o.config.Password
+	u, p, err := o.config.credentials()
+	if err != nil {
+		return err
+	}
 
-	err := o.controller.Login(u, p)
+	o.cMu.Lock()
+	err = o.controller.Login(u, p)
+	o.cMu.Unlock()
 	if err != nil {
 		return err
 	}
@@ -70,16 +122,17 @@ func (o *Omada) controllerInit(ctx context.Context) error {
 
 	log.Info("starting initial omada setup...")
 
-	const retrySeconds = 15
-	duration := time.Duration(retrySeconds) * time.Second
+	retry := newBackoff(o.config)
 
 	for {
 
 		err := o.controller.GetControllerInfo()
 		if err != nil {
 			if o.config.ignore_startup_errors {
-				log.Warning(err)
-				time.Sleep(duration)
+				o.health.failure("startup", err)
+				if err := sleepContext(ctx, retry.next()); err != nil {
+					return err
+				}
 				continue
 			} else {
 				return err
@@ -89,8 +142,10 @@ func (o *Omada) controllerInit(ctx context.Context) error {
 		err = o.login()
 		if err != nil {
 			if o.config.ignore_startup_errors {
-				log.Warning(err)
-				time.Sleep(duration)
+				o.health.failure("startup", err)
+				if err := sleepContext(ctx, retry.next()); err != nil {
+					return err
+				}
 				continue
 			} else {
 				return err
@@ -98,15 +153,13 @@ func (o *Omada) controllerInit(ctx context.Context) error {
 		}
 
 		// setup site list
-		var sites []string
-		for s := range o.controller.Sites {
-			sites = append(sites, s)
-		}
-		sites = filterSites(o.config.Site, sites)
+		sites := o.discoverSites()
 		if len(sites) == 0 {
 			if o.config.ignore_startup_errors {
-				log.Warning(err)
-				time.Sleep(duration)
+				o.health.failure("startup", errors.New("no sites found"))
+				if err := sleepContext(ctx, retry.next()); err != nil {
+					return err
+				}
 				continue
 			} else {
 				return errors.New("no sites found")
@@ -114,26 +167,34 @@ func (o *Omada) controllerInit(ctx context.Context) error {
 			}
 		}
 		log.Infof("found '%d' sites: %v", len(sites), sites)
+		o.uMu.Lock()
 		o.sites = sites
+		o.uMu.Unlock()
 
 		// initial zone update
 		err = o.updateZones()
 		if err != nil {
 			if o.config.ignore_startup_errors {
-				log.Warning(err)
-				time.Sleep(duration)
+				o.health.failure("startup", err)
+				if err := sleepContext(ctx, retry.next()); err != nil {
+					return err
+				}
 				continue
 			} else {
 				return err
 			}
 		}
 
+		o.health.success("startup")
 		log.Info("initial omada setup complete")
 		break
 	}
 
 	go updateSessionLoop(ctx, o)
 	go updateZoneLoop(ctx, o)
+	if o.config.site_refresh > 0 {
+		go updateSitesLoop(ctx, o)
+	}
 
 	return nil
 
@@ -1,10 +1,13 @@
 package coredns_omada
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSetup(t *testing.T) {
@@ -49,6 +52,24 @@ func TestSetup(t *testing.T) {
 			ignore_startup_errors true
 		}`, false},
 
+		// known clients
+		{fmt.Sprintf(`omada {
+			controller_url %s
+			username test
+			password test
+			site .*
+			resolve_known_clients true
+		}`, url), false},
+
+		// tls options require an https controller
+		{fmt.Sprintf(`omada {
+			controller_url %s
+			username test
+			password test
+			site .*
+			insecure_skip_verify true
+		}`, url), true},
+
 		// do not ignore connection errors to omada controller on startup
 		{`omada {
 			controller_url http://localhost:8888
@@ -66,3 +87,29 @@ func TestSetup(t *testing.T) {
 		}
 	}
 }
+
+func TestControllerInitCancelled(t *testing.T) {
+
+	testOmada, err := NewOmada(context.TODO(), "http://localhost:8888", "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestControllerInitCancelled/NewOmada': %v", err)
+	}
+	testOmada.config.ignore_startup_errors = true
+	testOmada.config.backoff_initial = time.Hour
+	testOmada.config.backoff_max = time.Hour
+	testOmada.config.backoff_multiplier = 2
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- testOmada.controllerInit(ctx) }()
+
+	// the retry delay is interrupted when the instance is shut down
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(5 * time.Second):
+		t.Fatal("controllerInit did not return after the context was cancelled")
+	}
+}
@@ -1,14 +1,140 @@
 package coredns_omada
 
-import "regexp"
+import (
+	"fmt"
+	"regexp"
+	"slices"
+)
 
-func filterSites(pattern string, sites []string) (results []string) {
+// siteFilter selects controller sites by name
+type siteFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newSiteFilter compiles the include and exclude site patterns. In exact mode
+// each value must match the whole site name, otherwise values are regular
+// expressions.
+func newSiteFilter(include []string, exclude []string, exact bool) (filter siteFilter, err error) {
+
+	compile := func(pattern string) (*regexp.Regexp, error) {
+		if exact {
+			pattern = "^" + regexp.QuoteMeta(pattern) + "$"
+		}
+		return regexp.Compile(pattern)
+	}
+
+	for _, pattern := range include {
+		re, err := compile(pattern)
+		if err != nil {
+			return filter, fmt.Errorf("invalid site pattern %q: %w", pattern, err)
+		}
+		filter.include = append(filter.include, re)
+	}
+	for _, pattern := range exclude {
+		re, err := compile(pattern)
+		if err != nil {
+			return filter, fmt.Errorf("invalid exclude_site pattern %q: %w", pattern, err)
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+	return filter, nil
+}
+
+// match reports whether a site matches any include pattern and no exclude
+// pattern. A filter without include patterns matches every site.
+func (f siteFilter) match(site string) bool {
+
+	for _, re := range f.exclude {
+		if re.MatchString(site) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(site) {
+			return true
+		}
+	}
+	return false
+}
+
+func filterSites(filter siteFilter, sites []string) (results []string) {
 
 	for _, site := range sites {
-		match, _ := regexp.MatchString(pattern, site)
-		if match {
+		if filter.match(site) {
 			results = append(results, site)
 		}
 	}
 	return
 }
+
+// diffSites returns the sites which are in next but not in current (added)
+// and the sites which are in current but not in next (removed)
+func diffSites(current []string, next []string) (added []string, removed []string) {
+
+	for _, site := range next {
+		if !slices.Contains(current, site) {
+			added = append(added, site)
+		}
+	}
+	for _, site := range current {
+		if !slices.Contains(next, site) {
+			removed = append(removed, site)
+		}
+	}
+	return
+}
+
+// discoverSites returns the controller sites which match the site pattern
+func (o *Omada) discoverSites() []string {
+
+	o.cMu.RLock()
+	var sites []string
+	for s := range o.controller.Sites {
+		sites = append(sites, s)
+	}
+	o.cMu.RUnlock()
+
+	sites = filterSites(o.config.site_filter, sites)
+	slices.Sort(sites)
+	return sites
+}
+
+// refreshSiteList fetches the controller's site list without logging in
+// again and hands it to the controller library, which selects sites by name
+func (o *Omada) refreshSiteList() error {
+
+	sites, err := o.api.getSites()
+	if err != nil {
+		return err
+	}
+	o.cMu.Lock()
+	o.controller.Sites = sites
+	o.cMu.Unlock()
+	return nil
+}
+
+// updateSites re-evaluates the site pattern against the controller's site list
+// and starts or stops fetching sites which were added or removed. Records from
+// removed sites are purged once they become stale. Callers must hold uMu.
+func (o *Omada) updateSites() {
+
+	sites := o.discoverSites()
+	if len(sites) == 0 {
+		log.Warningf("sites: no sites match %v, keeping current sites: %v", o.config.Site, o.sites)
+		return
+	}
+
+	added, removed := diffSites(o.sites, sites)
+	if len(added) > 0 {
+		log.Infof("sites: found new sites: %v", added)
+	}
+	for _, site := range removed {
+		log.Infof("sites: site removed: %s", site)
+		delete(o.siteCache, site)
+	}
+	o.sites = sites
+}
@@ -37,7 +37,86 @@ func TestFilterSites(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		actual := filterSites(test.pattern, test.sites)
+		filter, err := newSiteFilter([]string{test.pattern}, nil, false)
+		assert.NoError(t, err)
+		actual := filterSites(filter, test.sites)
 		assert.Equal(t, test.expected, actual)
 	}
 }
+
+func TestSiteFilter(t *testing.T) {
+
+	sites := []string{"home", "homelab", "branch-01", "branch-02", "branch-test"}
+
+	tests := []struct {
+		include  []string
+		exclude  []string
+		exact    bool
+		expected []string
+	}{
+		{ // multiple regex values
+			include:  []string{`^home$`, `^branch-\d+$`},
+			expected: []string{"home", "branch-01", "branch-02"},
+		},
+		{ // exclude regex
+			include:  []string{`.*`},
+			exclude:  []string{`test`, `lab`},
+			expected: []string{"home", "branch-01", "branch-02"},
+		},
+		{ // exact match
+			include:  []string{"home", "branch-01"},
+			exact:    true,
+			expected: []string{"home", "branch-01"},
+		},
+		{ // exact exclude
+			include:  []string{"home", "homelab", "branch-01"},
+			exclude:  []string{"home"},
+			exact:    true,
+			expected: []string{"homelab", "branch-01"},
+		},
+	}
+
+	for _, test := range tests {
+		filter, err := newSiteFilter(test.include, test.exclude, test.exact)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, filterSites(filter, sites))
+	}
+
+	_, err := newSiteFilter([]string{"home("}, nil, false)
+	assert.Error(t, err)
+
+	_, err = newSiteFilter([]string{"home("}, nil, true)
+	assert.NoError(t, err)
+}
+
+func TestDiffSites(t *testing.T) {
+
+	tests := []struct {
+		current []string
+		next    []string
+		added   []string
+		removed []string
+	}{
+		{
+			current: []string{"home", "work"},
+			next:    []string{"home", "work"},
+		},
+		{
+			current: []string{"home"},
+			next:    []string{"home", "work"},
+			added:   []string{"work"},
+		},
+		{
+			current: []string{"home", "work"},
+			next:    []string{"work", "branch"},
+			added:   []string{"branch"},
+			removed: []string{"home"},
+		},
+	}
+
+	for _, test := range tests {
+		added, removed := diffSites(test.current, test.next)
+		assert.Equal(t, test.added, added)
+		assert.Equal(t, test.removed, removed)
+	}
+}
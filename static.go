@@ -0,0 +1,123 @@
+package coredns_omada
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/miekg/dns"
+)
+
+// zoneFile is a zone file whose records are merged into the generated zones
+type zoneFile struct {
+	path   string
+	origin string
+}
+
+// parseStaticRecord parses an inline record from the Corefile. Names must be
+// fully qualified as the zones are only known once the controller is queried.
+func parseStaticRecord(s string) (dns.RR, error) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("no record found in %q", s)
+	}
+	if rr.Header().Rrtype == dns.TypeSOA {
+		return nil, fmt.Errorf("SOA records are generated by the plugin: %q", s)
+	}
+	if !hasRdata(rr) {
+		return nil, fmt.Errorf("record has no data: %q", s)
+	}
+	return rr, nil
+}
+
+// hasRdata reports whether a record has data. The parser accepts records
+// without data as they are valid in dynamic updates.
+func hasRdata(rr dns.RR) bool {
+	return strings.TrimSpace(strings.TrimPrefix(rr.String(), rr.Header().String())) != ""
+}
+
+// readZoneFile reads every record from a zone file, skipping SOA records
+func readZoneFile(zf zoneFile) ([]dns.RR, error) {
+	f, err := os.Open(zf.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []dns.RR
+	zp := dns.NewZoneParser(f, dns.Fqdn(zf.origin), zf.path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			continue
+		}
+		if !hasRdata(rr) {
+			return nil, fmt.Errorf("%s: record has no data: %s", zf.path, rr.Header().Name)
+		}
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// loadStaticRecords returns the inline records and the records from every
+// include_zonefile. Zone files are re-read on each call so changes are picked
+// up on the next refresh; if a file can no longer be read its previous records
+// are kept. Callers must hold uMu.
+func (o *Omada) loadStaticRecords() []dns.RR {
+
+	if o.zoneFileRecords == nil {
+		o.zoneFileRecords = make(map[string][]dns.RR)
+	}
+
+	records := append([]dns.RR{}, o.config.records...)
+	for _, zf := range o.config.zonefiles {
+		rrs, err := readZoneFile(zf)
+		if err != nil {
+			log.Warningf("update: failed to read zone file %s, keeping previous records: %v", zf.path, err)
+			rrs = o.zoneFileRecords[zf.path]
+		}
+		o.zoneFileRecords[zf.path] = rrs
+		records = append(records, rrs...)
+	}
+	return records
+}
+
+// staticNames returns the lower cased owner names of the static records
+func staticNames(records []dns.RR) map[string]bool {
+	names := make(map[string]bool)
+	for _, rr := range records {
+		names[strings.ToLower(rr.Header().Name)] = true
+	}
+	return names
+}
+
+// addStaticRecords inserts static records into the zone they belong to and
+// returns the record types which were added. Records outside of the managed
+// zones are skipped.
+func addStaticRecords(zones map[string]*file.Zone, zoneNames []string, records []dns.RR) (map[uint16]bool, []recordEntry) {
+
+	types := make(map[uint16]bool)
+	var entries []recordEntry
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header().Name)
+		zoneName := plugin.Zones(zoneNames).Matches(name)
+		if zoneName == "" {
+			log.Debugf("update: skipping static record outside of managed zones: %s", name)
+			continue
+		}
+		if err := zones[zoneName].Insert(dns.Copy(rr)); err != nil {
+			log.Warningf("update: failed to add static record %s: %v", rr, err)
+			continue
+		}
+		types[rr.Header().Rrtype] = true
+		entries = append(entries, recordEntry{zone: zoneName, rr: rr, recordInfo: recordInfo{source: "static"}})
+	}
+	return types, entries
+}
@@ -0,0 +1,124 @@
+package coredns_omada
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStaticRecord(t *testing.T) {
+
+	rr, err := parseStaticRecord("www.omada.test. 300 IN CNAME proxy.omada.test.")
+	assert.NoError(t, err)
+	assert.Equal(t, dns.TypeCNAME, rr.Header().Rrtype)
+
+	_, err = parseStaticRecord("omada.test. 300 IN SOA ns.omada.test. hostmaster.omada.test. 1 7200 3600 86400 300")
+	assert.Error(t, err)
+
+	_, err = parseStaticRecord("www.omada.test. 300 IN CNAME")
+	assert.Error(t, err)
+}
+
+func TestReadZoneFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "omada.test")
+	content := `$TTL 300
+@       IN SOA  ns hostmaster 1 7200 3600 86400 300
+mail    IN A    192.168.0.25
+@       IN MX   10 mail
+_sip._tcp IN SRV 10 5 5060 voip
+`
+	err := os.WriteFile(path, []byte(content), 0644)
+	assert.NoError(t, err)
+
+	records, err := readZoneFile(zoneFile{path: path, origin: "omada.test"})
+	assert.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.Equal(t, "mail.omada.test.", records[0].Header().Name)
+
+	_, err = readZoneFile(zoneFile{path: filepath.Join(t.TempDir(), "missing")})
+	assert.Error(t, err)
+}
+
+func TestStaticRecords(t *testing.T) {
+
+	o := testDynamicOmada()
+	o.config.records = []dns.RR{
+		mustParseStaticRecord(t, "www.omada.test. 300 IN CNAME client1.omada.test."),
+		mustParseStaticRecord(t, "omada.test. 300 IN MX 10 mail.omada.test."),
+		mustParseStaticRecord(t, "mail.omada.test. 300 IN A 192.168.0.25"),
+		mustParseStaticRecord(t, "outside.example.com. 300 IN A 192.168.0.26"),
+	}
+	o.static = o.loadStaticRecords()
+	o.buildZones(o.records)
+
+	executeTestCases(t, o, []testCases{
+		{ // cname to a controller record
+			qname: "www.omada.test.",
+			qtype: dns.TypeA,
+			wantAnswer: []string{
+				"www.omada.test.	300	IN	CNAME	client1.omada.test.",
+				"client1.omada.test.	60	IN	A	192.168.0.101",
+			},
+		},
+		{ // types of static records are served
+			qname:      "omada.test.",
+			qtype:      dns.TypeMX,
+			wantAnswer: []string{"omada.test.	300	IN	MX	10 mail.omada.test."},
+		},
+		{ // controller records are still served
+			qname:      "client1.omada.test.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client1.omada.test.	60	IN	A	192.168.0.101"},
+		},
+		{ // other types are passed to the next plugin
+			qname:        "client1.omada.test.",
+			qtype:        dns.TypeTXT,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+	})
+
+	// static records take precedence over controller records
+	o.config.records = append(o.config.records, mustParseStaticRecord(t, "client1.omada.test. 300 IN A 192.168.0.201"))
+	o.static = o.loadStaticRecords()
+	o.buildZones(o.records)
+	executeTestCases(t, o, []testCases{
+		{
+			qname:      "client1.omada.test.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client1.omada.test.	300	IN	A	192.168.0.201"},
+		},
+	})
+}
+
+func TestStaticZoneFileKeepsPreviousRecords(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "omada.test")
+	err := os.WriteFile(path, []byte("mail 300 IN A 192.168.0.25\n"), 0644)
+	assert.NoError(t, err)
+
+	o := testDynamicOmada()
+	o.config.stale_record_duration = 10 * time.Minute
+	o.config.zonefiles = []zoneFile{{path: path, origin: "omada.test."}}
+	assert.Len(t, o.loadStaticRecords(), 1)
+
+	// a broken zone file keeps the records from the last successful read
+	err = os.WriteFile(path, []byte("mail 300 IN A\n"), 0644)
+	assert.NoError(t, err)
+	_, err = readZoneFile(o.config.zonefiles[0])
+	assert.Error(t, err)
+	assert.Len(t, o.loadStaticRecords(), 1)
+}
+
+func mustParseStaticRecord(t *testing.T, s string) dns.RR {
+	rr, err := parseStaticRecord(s)
+	if err != nil {
+		t.Fatalf("failed to parse record %q: %v", s, err)
+	}
+	return rr
+}
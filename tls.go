@@ -0,0 +1,193 @@
+package coredns_omada
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// tlsOptions configures how the controller's certificate is verified
+type tlsOptions struct {
+	ca_file              string   // pem bundle of the certificate authorities to trust instead of the system roots
+	pins                 [][]byte // sha-256 fingerprints of which the controller's certificate must match one
+	server_name          string   // name the certificate is verified against instead of the controller_url host
+	insecure_skip_verify bool     // don't verify the controller's certificate at all
+}
+
+// enabled reports whether any tls option is set
+func (t tlsOptions) enabled() bool {
+	return t.ca_file != "" || len(t.pins) > 0 || t.server_name != "" || t.insecure_skip_verify
+}
+
+// parsePin parses a sha-256 fingerprint in hex, optionally separated by colons
+// as printed by `openssl x509 -fingerprint -sha256`
+func parsePin(s string) ([]byte, error) {
+
+	pin, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("not a sha-256 fingerprint: %q", s)
+	}
+	return pin, nil
+}
+
+// tlsConfig returns the tls configuration for the controller connection.
+// When fingerprints are pinned the certificate must match one of them and is
+// only verified against certificate authorities if ca_file is set too, so a
+// self-signed certificate can be trusted without disabling verification.
+func (t tlsOptions) tlsConfig() (*tls.Config, error) {
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         t.server_name,
+		InsecureSkipVerify: t.insecure_skip_verify,
+	}
+	if t.insecure_skip_verify {
+		if t.ca_file != "" || len(t.pins) > 0 {
+			return nil, errors.New("insecure_skip_verify can't be combined with tls_ca_file or tls_pin_sha256")
+		}
+		return config, nil
+	}
+
+	if t.ca_file != "" {
+		pem, err := os.ReadFile(t.ca_file)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", t.ca_file)
+		}
+	}
+
+	if len(t.pins) > 0 {
+		// the default verification is replaced, VerifyConnection runs for every connection
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPinnedConnection(cs, t.pins, roots, t.ca_file != "")
+		}
+	}
+	return config, nil
+}
+
+// verifyPinnedConnection checks that the controller's certificate matches a
+// pinned fingerprint and, if verifyChain is set, chains to one of the roots
+func verifyPinnedConnection(cs tls.ConnectionState, pins [][]byte, roots *x509.CertPool, verifyChain bool) error {
+
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("controller sent no certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	sum := sha256.Sum256(leaf.Raw)
+	pinned := false
+	for _, pin := range pins {
+		if bytes.Equal(pin, sum[:]) {
+			pinned = true
+			break
+		}
+	}
+	if !pinned {
+		return fmt.Errorf("controller certificate fingerprint %s does not match tls_pin_sha256", hex.EncodeToString(sum[:]))
+	}
+	if !verifyChain {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	return err
+}
+
+// startControllerProxy serves a plain http proxy to the controller on a
+// loopback address and returns its url. The omada library creates its own
+// http transport, so the controller is reached through the proxy to apply the
+// tls options to every request. The url ends in a random path which requests
+// must start with, so other local processes can't use the proxy to reach the
+// controller. The proxy is closed when ctx is done.
+func startControllerProxy(ctx context.Context, controllerURL string, config *tls.Config) (string, error) {
+
+	target, err := url.Parse(controllerURL)
+	if err != nil {
+		return "", err
+	}
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("error starting controller proxy: %w", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("error starting controller proxy: %w", err)
+	}
+	proxyURL := &url.URL{Scheme: "http", Host: listener.Addr().String(), Path: "/" + hex.EncodeToString(secret)}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+		},
+		Transport: transport,
+		ModifyResponse: func(res *http.Response) error {
+			rewriteProxyResponse(res, target, proxyURL)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Warningf("controller proxy: %s %s: %v", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		},
+	}
+
+	// requests without the random path are answered with 404 and never reach the controller
+	server := &http.Server{Handler: http.StripPrefix(proxyURL.Path, proxy), ReadHeaderTimeout: 30 * time.Second}
+	go server.Serve(listener)
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	log.Debugf("controller proxy for %s listening on %s", controllerURL, listener.Addr())
+	return proxyURL.String(), nil
+}
+
+// rewriteProxyResponse makes the controller's cookies and redirects usable by
+// a client of the proxy. Cookies lose their Secure and Domain attributes, as
+// the client talks plain http to a loopback address, and their path is moved
+// below the proxy's random path.
+func rewriteProxyResponse(res *http.Response, target *url.URL, proxyURL *url.URL) {
+
+	if cookies := res.Cookies(); len(cookies) > 0 {
+		res.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			cookie.Secure = false
+			cookie.Domain = ""
+			if cookie.Path != "" {
+				cookie.Path = proxyURL.Path + cookie.Path
+			}
+			res.Header.Add("Set-Cookie", cookie.String())
+		}
+	}
+
+	origin := target.Scheme + "://" + target.Host
+	if location, ok := strings.CutPrefix(res.Header.Get("Location"), origin); ok {
+		res.Header.Set("Location", proxyURL.String()+location)
+	}
+}
@@ -0,0 +1,249 @@
+package coredns_omada
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePin(t *testing.T) {
+
+	want := sha256.Sum256([]byte("test"))
+	tests := []struct {
+		pin     string
+		wantErr bool
+	}{
+		{"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", false},
+		{"9F:86:D0:81:88:4C:7D:65:9A:2F:EA:A0:C5:5A:D0:15:A3:BF:4F:1B:2B:0B:82:2C:D1:5D:6C:15:B0:F0:0A:08", false},
+		{"9f86d081", true},
+		{"sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", true},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		pin, err := parsePin(tt.pin)
+		if tt.wantErr {
+			assert.Error(t, err, tt.pin)
+			continue
+		}
+		assert.NoError(t, err, tt.pin)
+		assert.Equal(t, want[:], pin, tt.pin)
+	}
+}
+
+// selfSignedCertificate returns a new self-signed certificate for 127.0.0.1
+func selfSignedCertificate(t *testing.T) []byte {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "omada"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestTLSConfig(t *testing.T) {
+
+	// the test certificate is self-signed for 127.0.0.1 and *.example.com
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	other := selfSignedCertificate(t)
+
+	dir := t.TempDir()
+	writeCA := func(name string, der []byte) string {
+		path := filepath.Join(dir, name)
+		data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	caFile := writeCA("ca.pem", server.Certificate().Raw)
+	otherCAFile := writeCA("other.pem", other)
+	emptyFile := filepath.Join(dir, "empty.pem")
+	os.WriteFile(emptyFile, []byte("not a certificate"), 0o600)
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	pin := sum[:]
+	otherSum := sha256.Sum256(other)
+	otherPin := otherSum[:]
+
+	tests := []struct {
+		name       string
+		options    tlsOptions
+		wantConfig string // error building the config
+		wantErr    string // error connecting to the server
+	}{
+		{"system roots", tlsOptions{}, "", "certificate"},
+		{"ca file", tlsOptions{ca_file: caFile}, "", ""},
+		{"other ca file", tlsOptions{ca_file: otherCAFile}, "", "certificate"},
+		{"empty ca file", tlsOptions{ca_file: emptyFile}, "no certificates", ""},
+		{"server name", tlsOptions{ca_file: caFile, server_name: "example.com"}, "", ""},
+		{"wrong server name", tlsOptions{ca_file: caFile, server_name: "omada.test"}, "", "certificate"},
+		{"pin", tlsOptions{pins: [][]byte{pin}}, "", ""},
+		{"pin with a wrong server name", tlsOptions{pins: [][]byte{pin}, server_name: "omada.test"}, "", ""},
+		{"one of several pins", tlsOptions{pins: [][]byte{otherPin, pin}}, "", ""},
+		{"wrong pin", tlsOptions{pins: [][]byte{otherPin}}, "", "does not match"},
+		{"pin and ca file", tlsOptions{pins: [][]byte{pin}, ca_file: caFile}, "", ""},
+		{"pin and other ca file", tlsOptions{pins: [][]byte{pin}, ca_file: otherCAFile}, "", "certificate"},
+		{"pin and ca file with a wrong server name", tlsOptions{pins: [][]byte{pin}, ca_file: caFile, server_name: "omada.test"}, "", "certificate"},
+		{"insecure", tlsOptions{insecure_skip_verify: true}, "", ""},
+		{"insecure with pin", tlsOptions{insecure_skip_verify: true, pins: [][]byte{pin}}, "insecure_skip_verify", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.options.tlsConfig()
+			if tt.wantConfig != "" {
+				assert.ErrorContains(t, err, tt.wantConfig)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			resp, err := client.Get(server.URL)
+			if resp != nil {
+				resp.Body.Close()
+			}
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.True(t, strings.Contains(err.Error(), tt.wantErr), err.Error())
+				}
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestControllerProxy(t *testing.T) {
+
+	// the controller only accepts requests with the session cookie from the
+	// login, which is set for the controller's domain
+	controller := testControllerHandler(func(path string) bool { return false })
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/api/v2/login"):
+			http.SetCookie(w, &http.Cookie{Name: "TPOMADA_SESSIONID", Value: "session", Path: "/", Domain: "example.com", Secure: true, HttpOnly: true})
+		case strings.Contains(r.URL.Path, "/api/v2/"):
+			if cookie, err := r.Cookie("TPOMADA_SESSIONID"); err != nil || cookie.Value != "session" {
+				http.Error(w, "no session", http.StatusUnauthorized)
+				return
+			}
+		}
+		controller(w, r)
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	other := sha256.Sum256(selfSignedCertificate(t))
+
+	tests := []struct {
+		name    string
+		options tlsOptions
+		wantErr bool
+	}{
+		{"pin", tlsOptions{pins: [][]byte{sum[:]}}, false},
+		{"wrong pin", tlsOptions{pins: [][]byte{other[:]}}, true},
+		{"system roots", tlsOptions{server_name: "example.com"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.options.tlsConfig()
+			if !assert.NoError(t, err) {
+				return
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			proxyURL, err := startControllerProxy(ctx, server.URL, config)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.True(t, strings.HasPrefix(proxyURL, "http://127.0.0.1:"), proxyURL)
+
+			// requests without the random path don't reach the controller
+			u, _ := url.Parse(proxyURL)
+			assert.Len(t, u.Path, 33)
+			res, err := http.Get("http://" + u.Host + "/api/info")
+			if assert.NoError(t, err) {
+				res.Body.Close()
+				assert.Equal(t, http.StatusNotFound, res.StatusCode)
+			}
+
+			testOmada, err := NewOmada(ctx, proxyURL, "test", "test")
+			if !assert.NoError(t, err) {
+				return
+			}
+			testOmada.Next = testHandler()
+			testOmada.config.refresh = time.Minute
+			testOmada.config.login_refresh = 24 * time.Hour
+			testOmada.config.resolve_clients = true
+			testOmada.config.resolve_devices = true
+			testOmada.config.resolve_dhcp_reservations = true
+			testOmada.config.stale_record_duration = 5 * time.Minute
+
+			err = testOmada.controllerInit(ctx)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
+		})
+	}
+}
+
+func TestRewriteProxyResponse(t *testing.T) {
+
+	target, _ := url.Parse("https://10.0.0.1:8043")
+	res := &http.Response{Header: http.Header{}}
+	res.Header.Add("Set-Cookie", "TPOMADA_SESSIONID=abc; Path=/; Domain=10.0.0.1; Secure; HttpOnly")
+	res.Header.Set("Location", "https://10.0.0.1:8043/123/login")
+
+	proxyURL, _ := url.Parse("http://127.0.0.1:4000/secret")
+
+	rewriteProxyResponse(res, target, proxyURL)
+	assert.Equal(t, []string{"TPOMADA_SESSIONID=abc; Path=/secret/; HttpOnly"}, res.Header.Values("Set-Cookie"))
+	assert.Equal(t, "http://127.0.0.1:4000/secret/123/login", res.Header.Get("Location"))
+
+	// redirects to other hosts are kept
+	res.Header.Set("Location", "https://omada.example.com/login")
+	rewriteProxyResponse(res, target, proxyURL)
+	assert.Equal(t, "https://omada.example.com/login", res.Header.Get("Location"))
+}
@@ -0,0 +1,58 @@
+package coredns_omada
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin/pkg/trace"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	otext "github.com/opentracing/opentracing-go/ext"
+)
+
+// setTracePlugin traces refreshes with the tracer of the trace plugin in the
+// same server block. The tracer is only created when the trace plugin starts,
+// so the plugin is kept instead of the tracer.
+func (o *Omada) setTracePlugin(t trace.Trace) {
+	o.tracePlugin.Store(t)
+}
+
+// refreshTracer returns the tracer refreshes are traced with, a no-op tracer
+// unless the trace plugin is used and started
+func (o *Omada) refreshTracer() ot.Tracer {
+	if t, ok := o.tracePlugin.Load().(trace.Trace); ok {
+		if tracer := t.Tracer(); tracer != nil {
+			return tracer
+		}
+	}
+	return ot.NoopTracer{}
+}
+
+// childSpan starts a span below the parent span
+func childSpan(parent ot.Span, operation string) ot.Span {
+	return parent.Tracer().StartSpan(operation, ot.ChildOf(parent.Context()))
+}
+
+// finishSpan marks the span as failed if there is an error and finishes it
+func finishSpan(span ot.Span, err error) {
+	if err != nil {
+		otext.LogError(span, err)
+	}
+	span.Finish()
+}
+
+// queryDecision records how a query was handled in the structured event log
+// and as an event on the query's span when the trace plugin traces the query
+func (o *Omada) queryDecision(ctx context.Context, qname string, qtype uint16, zone string, decision string, answers int) {
+
+	o.events.queryDecision(qname, qtype, zone, decision, answers)
+	if span := ot.SpanFromContext(ctx); span != nil {
+		span.LogKV(
+			"event", "omada.query",
+			"qname", qname,
+			"qtype", dns.TypeToString[qtype],
+			"zone", zone,
+			"decision", decision,
+			"answers", answers,
+		)
+	}
+}
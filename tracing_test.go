@@ -0,0 +1,148 @@
+package coredns_omada
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+)
+
+// testTrace is a trace plugin with a mock tracer
+type testTrace struct {
+	plugin.Handler
+	tracer ot.Tracer
+}
+
+func (t testTrace) Tracer() ot.Tracer { return t.tracer }
+
+func TestRefreshTracer(t *testing.T) {
+
+	o := &Omada{}
+	assert.Equal(t, ot.NoopTracer{}, o.refreshTracer())
+
+	// the trace plugin hasn't started yet
+	o.setTracePlugin(testTrace{})
+	assert.Equal(t, ot.NoopTracer{}, o.refreshTracer())
+
+	tracer := mocktracer.New()
+	o.setTracePlugin(testTrace{tracer: tracer})
+	assert.Equal(t, tracer, o.refreshTracer())
+}
+
+func TestUpdateWithTracing(t *testing.T) {
+
+	testServer := setupFailingTestServer(func(path string) bool {
+		return strings.HasSuffix(path, "/setting/service/dhcp")
+	})
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithTracing/NewOmada': %v", err)
+	}
+	tracer := mocktracer.New()
+	testOmada.Next = testHandler()
+	testOmada.config.Site = []string{".*"}
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.setTracePlugin(testTrace{tracer: tracer})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithTracing/controllerInit': %v", err)
+	}
+
+	spans := make(map[string]*mocktracer.MockSpan)
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	if !assert.Len(t, spans, 6) {
+		return
+	}
+
+	refresh := spans["omada.refresh"]
+	assert.Equal(t, 0, refresh.ParentID)
+	assert.Equal(t, 1, refresh.Tag("sites"))
+	assert.Equal(t, 1, refresh.Tag("failures"))
+	assert.Nil(t, refresh.Tag("error"))
+
+	site := spans["omada.site"]
+	assert.Equal(t, refresh.SpanContext.SpanID, site.ParentID)
+	assert.Equal(t, "Home", site.Tag("site"))
+	assert.Equal(t, true, site.Tag("error"))
+
+	for _, call := range []string{"GetNetworks", "GetClients", "GetDevices", "GetDhcpReservations"} {
+		span := spans[call]
+		if !assert.NotNil(t, span, call) {
+			continue
+		}
+		assert.Equal(t, site.SpanContext.SpanID, span.ParentID, call)
+		assert.Equal(t, "Home", span.Tag("site"), call)
+		if call == "GetDhcpReservations" {
+			assert.Equal(t, true, span.Tag("error"), call)
+		} else {
+			assert.Nil(t, span.Tag("error"), call)
+		}
+	}
+}
+
+func TestServeDNSWithTracing(t *testing.T) {
+
+	o := testDynamicOmada()
+	tracer := mocktracer.New()
+
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		zone     string
+		decision string
+	}{
+		{"client1.omada.test.", dns.TypeA, "omada.test.", "answer"},
+		{"client1.omada.test.", dns.TypeMX, "", "unsupported_type"},
+		{"www.example.com.", dns.TypeA, "", "unmanaged_zone"},
+	}
+
+	for _, tt := range tests {
+		span := tracer.StartSpan("omada")
+		ctx := ot.ContextWithSpan(context.Background(), span)
+		req := new(dns.Msg)
+		req.SetQuestion(tt.qname, tt.qtype)
+		o.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{}), req)
+		span.Finish()
+
+		logs := span.(*mocktracer.MockSpan).Logs()
+		if !assert.Len(t, logs, 1, tt.qname) {
+			continue
+		}
+		fields := make(map[string]string)
+		for _, f := range logs[0].Fields {
+			fields[f.Key] = f.ValueString
+		}
+		assert.Equal(t, "omada.query", fields["event"])
+		assert.Equal(t, tt.qname, fields["qname"])
+		assert.Equal(t, dns.TypeToString[tt.qtype], fields["qtype"])
+		assert.Equal(t, tt.zone, fields["zone"])
+		assert.Equal(t, tt.decision, fields["decision"])
+	}
+
+	// queries without a span are not traced
+	finished := len(tracer.FinishedSpans())
+	req := new(dns.Msg)
+	req.SetQuestion("client1.omada.test.", dns.TypeA)
+	o.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	assert.Len(t, tracer.FinishedSpans(), finished)
+}
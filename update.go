@@ -2,25 +2,58 @@ package coredns_omada
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
 	"net"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin/file"
 	omada "github.com/dougbw/go-omada"
 	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
 )
 
 type ARecord struct {
 	record    *dns.A
 	timestamp time.Time
+	maxAge    time.Duration // overrides stale_record_duration when set
+	recordInfo
 }
 
 type PtrRecord struct {
 	record    *dns.PTR
 	timestamp time.Time
+	maxAge    time.Duration // overrides stale_record_duration when set
+	recordInfo
+}
+
+// recordInfo describes where a record came from
+type recordInfo struct {
+	source string // client, known client, device, reservation or dynamic
+	mac    string
+	site   string
+}
+
+// siteData holds the data last fetched from the controller for a single site
+type siteData struct {
+	networks     []omada.OmadaNetwork
+	clients      []omada.Client
+	knownClients []omada.Client
+	devices      []omada.Device
+	reservations []omada.DhcpReservation
+}
+
+// siteResult is the outcome of fetching every data source for a single site
+type siteResult struct {
+	data     siteData
+	attempts int
+	failures []error
+	stale    []string // sources which failed and hold the data of an earlier fetch
 }
 
 type DnsRecords struct {
@@ -28,30 +61,63 @@ type DnsRecords struct {
 	PtrRecords map[string]PtrRecord
 }
 
-// refresh the DNS zones every X minutes
+// refresh the DNS zones at the configured interval, backing off while the controller is failing.
+// Forced refreshes run no sooner than refresh_debounce after the previous refresh.
 func updateZoneLoop(ctx context.Context, o *Omada) {
 
-	delay := time.Duration(o.config.refresh_minutes) * time.Minute
-	timer := time.NewTimer(delay)
+	refresh := o.config.refresh
+	retry := newBackoff(o.config)
+	last := time.Now()
+	next := last.Add(refresh)
+	timer := time.NewTimer(refresh)
 	defer timer.Stop()
 	for {
-		timer.Reset(delay)
+		timer.Reset(time.Until(next))
 		select {
 		case <-ctx.Done():
 			log.Debugf("Breaking out of zone update loop: %v", ctx.Err())
 			return
+		case <-o.refreshRequests:
+			if forced := last.Add(o.config.refresh_debounce); forced.Before(next) {
+				log.Debugf("update: forced refresh scheduled in %s", time.Until(forced).Round(time.Second))
+				next = forced
+			}
 		case <-timer.C:
-			if err := o.updateZones(); err != nil && ctx.Err() == nil {
-				log.Errorf("Failed to update zones: %v", err)
+			last = time.Now()
+			err := o.updateZones()
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				o.health.failure("refresh", fmt.Errorf("failed to update zones: %w", err))
+				next = time.Now().Add(max(refresh, retry.next()))
+				continue
 			}
+			o.health.success("refresh")
+			retry.reset()
+			next = time.Now().Add(refresh)
 		}
 	}
 }
 
-// refresh the login session token every X hours
+// requestRefresh asks the zone update loop for an immediate refresh and
+// reports whether the request was queued. Requests made while one is already
+// pending are merged into it.
+func (o *Omada) requestRefresh() bool {
+	select {
+	case o.refreshRequests <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// refresh the login session token at the configured interval, retrying with backoff on failure
 func updateSessionLoop(ctx context.Context, o *Omada) {
 
-	delay := time.Duration(o.config.refresh_login_hours) * time.Hour
+	refresh := o.config.login_refresh
+	retry := newBackoff(o.config)
+	delay := refresh
 	timer := time.NewTimer(delay)
 	defer timer.Stop()
 	for {
@@ -61,9 +127,54 @@ func updateSessionLoop(ctx context.Context, o *Omada) {
 			log.Debugf("Breaking out of login update loop: %v", ctx.Err())
 			return
 		case <-timer.C:
-			if err := o.login(); err != nil && ctx.Err() == nil {
-				log.Errorf("Failed to login to controller : %v", err)
+			err := o.login()
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				o.health.failure("login", fmt.Errorf("failed to login to controller: %w", err))
+				delay = retry.next()
+				continue
+			}
+			o.health.success("login")
+			retry.reset()
+			delay = refresh
+		}
+	}
+}
+
+// refresh the controller's site list at the configured interval so new sites
+// are picked up without restarting
+func updateSitesLoop(ctx context.Context, o *Omada) {
+
+	refresh := o.config.site_refresh
+	retry := newBackoff(o.config)
+	delay := refresh
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	for {
+		timer.Reset(delay)
+		select {
+		case <-ctx.Done():
+			log.Debugf("Breaking out of site update loop: %v", ctx.Err())
+			return
+		case <-timer.C:
+			err := o.refreshSiteList()
+			if ctx.Err() != nil {
+				continue
+			}
+			if err != nil {
+				o.health.failure("site discovery", fmt.Errorf("failed to refresh site list: %w", err))
+				delay = retry.next()
+				continue
 			}
+			o.health.success("site discovery")
+			retry.reset()
+			delay = refresh
+
+			o.uMu.Lock()
+			o.updateSites()
+			o.uMu.Unlock()
 		}
 	}
 }
@@ -72,53 +183,102 @@ func updateSessionLoop(ctx context.Context, o *Omada) {
 func (o *Omada) updateZones() error {
 
 	log.Info("update: updating zones...")
+	start := time.Now()
+	span := o.refreshTracer().StartSpan("omada.refresh")
+
+	// fallback targets are looked up before locking as the resolver can be slow
+	fallbackLookups := o.resolveExternalFallbacks()
+
+	o.uMu.Lock()
+	defer o.uMu.Unlock()
+
+	if o.siteCache == nil {
+		o.siteCache = make(map[string]siteData)
+	}
+	o.updateSites()
+
+	// fetch sites concurrently, each worker uses its own copy of the
+	// controller so the selected site is scoped to that worker
+	results := make([]siteResult, len(o.sites))
+	workers := make(chan struct{}, max(1, o.config.site_workers))
+	var wg sync.WaitGroup
+	for i, s := range o.sites {
+		previous := o.siteCache[s]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workers <- struct{}{}
+			defer func() { <-workers }()
+			results[i] = o.fetchSite(span, s, previous)
+		}()
+	}
+	wg.Wait()
 
 	var networks []omada.OmadaNetwork
 	var clients []omada.Client
+	var knownClients []omada.Client
 	var devices []omada.Device
 	var reservations []omada.DhcpReservation
-	for _, s := range o.sites {
-
-		log.Debugf("update: getting networks for site: %s", s)
-		o.controller.SetSite(s)
-		n, err := o.controller.GetNetworks()
-		if err != nil {
-			return fmt.Errorf("error getting networks from omada controller: %w", err)
+	var failures []error
+	attempts := 0
+	entrySites := make(map[string]string) // mac -> site of clients, devices and reservations
+	for i, s := range o.sites {
+		result := results[i]
+		o.siteCache[s] = result.data
+		o.events.refreshSite(s, result)
+		attempts += result.attempts
+		failures = append(failures, result.failures...)
+		for _, c := range result.data.clients {
+			entrySites[c.MAC] = s
 		}
-		interfaces := getInterfaces(n)
-		networks = append(networks, interfaces...)
-
-		if o.config.resolve_clients {
-			log.Debugf("update: getting clients for site: %s", s)
-			c, err := o.controller.GetClients()
-			if err != nil {
-				return fmt.Errorf("error getting clients from omada controller: %w", err)
-			}
-			clients = append(clients, c...)
+		for _, c := range result.data.knownClients {
+			entrySites[c.MAC] = s
 		}
-
-		if o.config.resolve_devices {
-			log.Debugf("update: getting devices for site: %s", s)
-			d, err := o.controller.GetDevices()
-			if err != nil {
-				return fmt.Errorf("error getting devices from omada controller: %w", err)
-			}
-			devices = append(devices, d...)
+		for _, d := range result.data.devices {
+			entrySites[d.Mac] = s
+		}
+		for _, r := range result.data.reservations {
+			entrySites[r.Mac] = s
 		}
 
-		if o.config.resolve_dhcp_reservations {
-			log.Debugf("update: getting dhcp reservations for site: %s", s)
-			r, err := o.controller.GetDhcpReservations()
-			if err != nil {
-				return fmt.Errorf("error getting dhcp reservations from omada controller: %w", err)
-			}
-			reservations = append(reservations, r...)
+		// records of a failed source are not added again, so the records from
+		// its last successful fetch keep their timestamps and become stale
+		networks = append(networks, getInterfaces(result.data.networks)...)
+		if !slices.Contains(result.stale, "clients") {
+			clients = append(clients, result.data.clients...)
 		}
+		if !slices.Contains(result.stale, "known clients") {
+			knownClients = append(knownClients, result.data.knownClients...)
+		}
+		if !slices.Contains(result.stale, "devices") {
+			devices = append(devices, result.data.devices...)
+		}
+		if !slices.Contains(result.stale, "dhcp reservations") {
+			reservations = append(reservations, result.data.reservations...)
+		}
+	}
+
+	// nothing was fetched successfully so there is nothing new to apply
+	if attempts > 0 && len(failures) == attempts {
+		err := errors.Join(failures...)
+		o.setRefreshStatus(start, failures, err)
+		o.events.refreshDone(start, len(o.sites), 0, attempts, failures, err)
+		span.SetTag("failures", len(failures))
+		finishSpan(span, err)
+		return err
+	}
+	if len(failures) > 0 {
+		log.Warningf("update: %d of %d controller requests failed, serving previous records for the failed sources", len(failures), attempts)
 	}
+
 	if o.config.resolve_clients {
 		log.Debugf("update: found '%d' clients\n", len(clients))
 	}
 
+	if o.config.resolve_known_clients {
+		log.Debugf("update: found '%d' known clients\n", len(knownClients))
+	}
+
 	if o.config.resolve_devices {
 		log.Debugf("update: found '%d' devices\n", len(devices))
 	}
@@ -145,7 +305,7 @@ func (o *Omada) updateZones() error {
 			log.Debugf("update: skipping network: %s because not DNS search domain is set", network.Name)
 			continue
 		}
-		dnsDomain := network.Domain + "."
+		dnsDomain := strings.ToLower(network.Domain) + "."
 
 		// create record map
 		_, ok := records[dnsDomain]
@@ -164,6 +324,9 @@ func (o *Omada) updateZones() error {
 			log.Debugf("failed to parse network cidr: %v, %v", err, subnet)
 			continue
 		}
+		// known clients are added first so records for active clients take precedence
+		o.addKnownClientRecords(records, network, subnet, dnsDomain, knownClients, entrySites, timestamp)
+
 		for _, client := range clients {
 
 			// if client is in this networks subnet then add record to zone
@@ -172,25 +335,25 @@ func (o *Omada) updateZones() error {
 				continue
 			}
 			if subnet.Contains(ip) {
+				if !o.config.client_filter.match(clientAttributes(network, client)) {
+					log.Debugf("update: client %s excluded by filter", client.MAC)
+					continue
+				}
+				if o.config.clients_active_only && !client.Active {
+					log.Debugf("update: client %s skipped because it is not active", client.MAC)
+					continue
+				}
+				clientTimestamp := timestamp
+				if o.config.clients_use_last_seen {
+					clientTimestamp = lastSeenTime(client.LastSeen, timestamp)
+				}
 				dnsName := client.Name
 				if client.Name == client.MAC && client.HostName != "--" {
 					dnsName = client.HostName
 				}
 				clientFqdn := fmt.Sprintf("%s.%s", makeDNSSafe(dnsName), dnsDomain)
-				a := &dns.A{Hdr: dns.RR_Header{Name: clientFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-					A: net.ParseIP(client.Ip)}
-				records[dnsDomain].ARecords[clientFqdn] = ARecord{
-					record:    a,
-					timestamp: timestamp,
-				}
-
-				ptrName := getPtrZoneFromIp(client.Ip)
-				ptr := &dns.PTR{Hdr: dns.RR_Header{Name: ptrName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
-					Ptr: dns.Fqdn(clientFqdn)}
-				records[ptrZone].PtrRecords[ptrName] = PtrRecord{
-					record:    ptr,
-					timestamp: timestamp,
-				}
+				info := recordInfo{source: "client", mac: client.MAC, site: entrySites[client.MAC]}
+				addRecord(records, dnsDomain, clientFqdn, ip, 60, clientTimestamp, 0, info)
 			}
 		}
 
@@ -198,22 +361,13 @@ func (o *Omada) updateZones() error {
 		for _, device := range devices {
 			ip := net.ParseIP(device.IP)
 			if subnet.Contains(ip) {
-				deviceFqdn := fmt.Sprintf("%s.%s", makeDNSSafe(device.DnsName), dnsDomain)
-				a := &dns.A{Hdr: dns.RR_Header{Name: deviceFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-					A: net.ParseIP(device.IP)}
-				records[dnsDomain].ARecords[deviceFqdn] = ARecord{
-					record:    a,
-					timestamp: timestamp,
+				if !o.config.device_filter.match(networkAttributes(network)) {
+					log.Debugf("update: device %s excluded by filter", device.DnsName)
+					continue
 				}
-
-				ptrName := getPtrZoneFromIp(device.IP)
-				ptr := &dns.PTR{Hdr: dns.RR_Header{Name: ptrName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
-					Ptr: dns.Fqdn(deviceFqdn)}
-				records[ptrZone].PtrRecords[ptrName] = PtrRecord{
-					record:    ptr,
-					timestamp: timestamp,
-				}
-
+				deviceFqdn := fmt.Sprintf("%s.%s", makeDNSSafe(device.DnsName), dnsDomain)
+				info := recordInfo{source: "device", mac: device.Mac, site: entrySites[device.Mac]}
+				addRecord(records, dnsDomain, deviceFqdn, ip, 60, timestamp, 0, info)
 			}
 		}
 
@@ -227,32 +381,48 @@ func (o *Omada) updateZones() error {
 				continue
 			}
 			if subnet.Contains(ip) {
+				if !o.config.reservation_filter.match(networkAttributes(network)) {
+					log.Debugf("update: dhcp reservation %s excluded by filter", reservation.Mac)
+					continue
+				}
 				dnsName := reservation.ClientName
 				if reservation.ClientName == reservation.Mac && reservation.Description != "" {
 					dnsName = reservation.Description
 				}
 				reservationFqdn := fmt.Sprintf("%s.%s", makeDNSSafeAllowWildcard(dnsName), dnsDomain)
-				a := &dns.A{Hdr: dns.RR_Header{Name: reservationFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-					A: net.ParseIP(reservation.IP)}
-				records[dnsDomain].ARecords[reservationFqdn] = ARecord{
-					record:    a,
-					timestamp: timestamp,
-				}
-
-				ptrName := getPtrZoneFromIp(reservation.IP)
-				ptr := &dns.PTR{Hdr: dns.RR_Header{Name: ptrName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
-					Ptr: dns.Fqdn(reservationFqdn)}
-				records[ptrZone].PtrRecords[ptrName] = PtrRecord{
-					record:    ptr,
-					timestamp: timestamp,
-				}
+				info := recordInfo{source: "reservation", mac: reservation.Mac, site: entrySites[reservation.Mac]}
+				addRecord(records, dnsDomain, reservationFqdn, ip, 60, timestamp, 0, info)
 			}
 		}
 
 	}
 
-	// add records to zone
+	o.static = o.loadStaticRecords()
+	o.storeExternalFallbacks(fallbackLookups, slices.Collect(maps.Keys(records)))
+	o.buildZones(records)
+	o.setRefreshStatus(start, failures, nil)
+	o.events.refreshDone(start, len(o.sites), len(o.entries), attempts, failures, nil)
+	span.SetTag("sites", len(o.sites))
+	span.SetTag("records", len(o.entries))
+	span.SetTag("failures", len(failures))
+	finishSpan(span, nil)
+
+	return nil
+}
+
+// buildZones creates the zones served by the plugin from the controller
+// records, the records added by dynamic updates and the static records.
+// Static records take precedence over the other records with the same name.
+// Controller records take precedence over dynamic records unless
+// update_override is set, also when the controller record appears after the
+// dynamic update. Callers must hold uMu.
+func (o *Omada) buildZones(records map[string]DnsRecords) {
+
+	static := staticNames(o.static)
+
+	// add records to zone, keeping the records which are actually served
 	zones := make(map[string]*file.Zone)
+	var entries []recordEntry
 	for dnsDomain, domainRecords := range records {
 		_, ok := zones[dnsDomain]
 		if !ok {
@@ -261,15 +431,36 @@ func (o *Omada) updateZones() error {
 			addSoaRecord(zones[dnsDomain], dnsDomain)
 		}
 		domainRecords.purgeStaleRecords(o.config.stale_record_duration.Seconds())
+		dynamic := o.updates[dnsDomain]
+		dynamic.purgeStaleRecords(o.config.stale_record_duration.Seconds())
 
-		// Add fallback record to zone if configured and applicable
-		o.addFallbackRecord(zones, dnsDomain, domainRecords)
-
-		for _, v := range domainRecords.ARecords {
+		for k, v := range domainRecords.ARecords {
+			if _, ok := dynamic.ARecords[k]; (ok && o.config.update_override) || static[k] {
+				continue
+			}
+			zones[dnsDomain].Insert(v.record)
+			entries = append(entries, recordEntry{zone: dnsDomain, rr: v.record, timestamp: v.timestamp, recordInfo: v.recordInfo})
+		}
+		for k, v := range dynamic.ARecords {
+			if _, ok := domainRecords.ARecords[k]; (ok && !o.config.update_override) || static[k] {
+				continue
+			}
 			zones[dnsDomain].Insert(v.record)
+			entries = append(entries, recordEntry{zone: dnsDomain, rr: v.record, timestamp: v.timestamp, recordInfo: v.recordInfo})
 		}
-		for _, v := range domainRecords.PtrRecords {
+		for k, v := range domainRecords.PtrRecords {
+			if _, ok := dynamic.PtrRecords[k]; (ok && o.config.update_override) || static[k] {
+				continue
+			}
+			zones[ptrZone].Insert(v.record)
+			entries = append(entries, recordEntry{zone: ptrZone, rr: v.record, timestamp: v.timestamp, recordInfo: v.recordInfo})
+		}
+		for k, v := range dynamic.PtrRecords {
+			if _, ok := domainRecords.PtrRecords[k]; (ok && !o.config.update_override) || static[k] {
+				continue
+			}
 			zones[ptrZone].Insert(v.record)
+			entries = append(entries, recordEntry{zone: ptrZone, rr: v.record, timestamp: v.timestamp, recordInfo: v.recordInfo})
 		}
 		log.Debugf("update: zone %s contains %d records", dnsDomain, zones[dnsDomain].Count)
 	}
@@ -280,13 +471,135 @@ func (o *Omada) updateZones() error {
 		zoneNames = append(zoneNames, k)
 	}
 
+	servedTypes, staticEntries := addStaticRecords(zones, zoneNames, o.static)
+	entries = append(entries, staticEntries...)
+	fallbackTypes, fallbackEntries := o.addFallbackRecords(zones, records)
+	for t := range fallbackTypes {
+		servedTypes[t] = true
+	}
+	entries = append(entries, fallbackEntries...)
+	previous := o.entries
+
 	o.zMu.Lock()
 	o.zones = zones
 	o.zoneNames = zoneNames
 	o.records = records
+	o.servedTypes = servedTypes
+	o.entries = entries
 	o.zMu.Unlock()
 
-	return nil
+	o.exportZoneFiles(zones)
+	o.exportHosts(zones)
+
+	// the first build has nothing to compare against
+	if o.built {
+		o.publishChanges(diffRecords(previous, entries, time.Now()))
+	}
+	o.built = true
+}
+
+// fetchSite gets every enabled data source for a single site. A failing
+// source keeps the data from its last successful fetch so one broken api call
+// does not discard records from everything else.
+func (o *Omada) fetchSite(parent ot.Span, site string, previous siteData) (result siteResult) {
+
+	span := childSpan(parent, "omada.site")
+	span.SetTag("site", site)
+	defer func() {
+		finishSpan(span, errors.Join(result.failures...))
+	}()
+
+	controller, err := o.siteController(site)
+	if err != nil {
+		// the site is no longer known to the controller session, keep its previous data
+		log.Warningf("update: failed to select site %s, keeping previous entries: %v", site, err)
+		result.data = previous
+		result.attempts++
+		result.failures = append(result.failures, fmt.Errorf("error selecting site %s: %w", site, err))
+		result.stale = []string{"networks", "clients", "known clients", "devices", "dhcp reservations"}
+		return result
+	}
+
+	result.attempts++
+	result.data.networks, err = fetchSource(span, "GetNetworks", site, "networks", controller.GetNetworks, previous.networks)
+	if err != nil {
+		result.failures = append(result.failures, err)
+		result.stale = append(result.stale, "networks")
+	}
+
+	if o.config.resolve_clients {
+		result.attempts++
+		result.data.clients, err = fetchSource(span, "GetClients", site, "clients", controller.GetClients, previous.clients)
+		if err != nil {
+			result.failures = append(result.failures, err)
+			result.stale = append(result.stale, "clients")
+		}
+	}
+
+	if o.config.resolve_known_clients {
+		getKnownClients := func() ([]omada.Client, error) {
+			return o.api.getKnownClients(site)
+		}
+		result.attempts++
+		result.data.knownClients, err = fetchSource(span, "GetKnownClients", site, "known clients", getKnownClients, previous.knownClients)
+		if err != nil {
+			result.failures = append(result.failures, err)
+			result.stale = append(result.stale, "known clients")
+		}
+	}
+
+	if o.config.resolve_devices {
+		result.attempts++
+		result.data.devices, err = fetchSource(span, "GetDevices", site, "devices", controller.GetDevices, previous.devices)
+		if err != nil {
+			result.failures = append(result.failures, err)
+			result.stale = append(result.stale, "devices")
+		}
+	}
+
+	if o.config.resolve_dhcp_reservations {
+		result.attempts++
+		result.data.reservations, err = fetchSource(span, "GetDhcpReservations", site, "dhcp reservations", controller.GetDhcpReservations, previous.reservations)
+		if err != nil {
+			result.failures = append(result.failures, err)
+			result.stale = append(result.stale, "dhcp reservations")
+		}
+	}
+
+	return result
+}
+
+// siteController returns a copy of the logged in controller with the site
+// selected. The copy shares the session but not the current site, so sites can
+// be queried concurrently. It fails if the site is not in the session's site
+// list, rather than querying the previously selected site.
+func (o *Omada) siteController(site string) (*omada.Controller, error) {
+	o.cMu.RLock()
+	controller := o.controller
+	o.cMu.RUnlock()
+	if err := controller.SetSite(site); err != nil {
+		return nil, err
+	}
+	return &controller, nil
+}
+
+// fetchSource gets one data source for a site from the controller, traced as
+// a span named after the api call. If the request fails the previous result
+// for that site and source is returned alongside the error.
+func fetchSource[T any](parent ot.Span, call string, site string, source string, fetch func() ([]T, error), previous []T) ([]T, error) {
+	log.Debugf("update: getting %s for site: %s", source, site)
+	span := childSpan(parent, call)
+	span.SetTag("site", site)
+	result, err := fetch()
+	finishSpan(span, err)
+	if err != nil {
+		refreshErrorCount.WithLabelValues(site, source).Inc()
+		sourceUp.WithLabelValues(site, source).Set(0)
+		log.Warningf("update: error getting %s for site %s, keeping %d previous entries: %v", source, site, len(previous), err)
+		return previous, fmt.Errorf("error getting %s for site %s from omada controller: %w", source, site, err)
+	}
+	sourceUp.WithLabelValues(site, source).Set(1)
+	return result, nil
 }
 
 func getInterfaces(networks []omada.OmadaNetwork) (ret []omada.OmadaNetwork) {
@@ -299,89 +612,92 @@ func getInterfaces(networks []omada.OmadaNetwork) (ret []omada.OmadaNetwork) {
 	return
 }
 
+// addKnownClientRecords adds records for known clients in a network. Known
+// clients may be offline, so their records use the time they were last seen
+// and are kept for the known client retention instead of stale_record_duration.
+func (o *Omada) addKnownClientRecords(records map[string]DnsRecords, network omada.OmadaNetwork, subnet *net.IPNet, dnsDomain string, knownClients []omada.Client, sites map[string]string, now time.Time) {
+
+	ttl := uint32(o.config.known_clients_ttl.Seconds())
+	for _, client := range knownClients {
+		ip := net.ParseIP(client.Ip)
+		if ip == nil || !subnet.Contains(ip) {
+			continue
+		}
+		if !o.config.client_filter.match(clientAttributes(network, client)) {
+			log.Debugf("update: known client %s excluded by filter", client.MAC)
+			continue
+		}
+		timestamp := lastSeenTime(client.LastSeen, now)
+
+		dnsName := client.Name
+		if client.Name == client.MAC && client.HostName != "--" && client.HostName != "" {
+			dnsName = client.HostName
+		}
+		clientFqdn := fmt.Sprintf("%s.%s", makeDNSSafe(dnsName), dnsDomain)
+		info := recordInfo{source: "known client", mac: client.MAC, site: sites[client.MAC]}
+		addRecord(records, dnsDomain, clientFqdn, ip, ttl, timestamp, o.config.known_clients_retention, info)
+	}
+}
+
+// addRecord adds an A record for a controller entry and the PTR record pointing to it
+func addRecord(records map[string]DnsRecords, dnsDomain string, fqdn string, ip net.IP, ttl uint32, timestamp time.Time, maxAge time.Duration, info recordInfo) {
+
+	a := &dns.A{Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A: ip}
+	records[dnsDomain].ARecords[fqdn] = ARecord{
+		record:     a,
+		timestamp:  timestamp,
+		maxAge:     maxAge,
+		recordInfo: info,
+	}
+
+	ptrName := getPtrZoneFromIp(ip.String())
+	ptr := &dns.PTR{Hdr: dns.RR_Header{Name: ptrName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: dns.Fqdn(fqdn)}
+	records[ptrZone].PtrRecords[ptrName] = PtrRecord{
+		record:     ptr,
+		timestamp:  timestamp,
+		maxAge:     maxAge,
+		recordInfo: info,
+	}
+}
+
+// lastSeenTime converts a controller lastSeen value (unix milliseconds) to a
+// record timestamp. Missing values and values in the future use now.
+func lastSeenTime(lastSeen int64, now time.Time) time.Time {
+	if lastSeen <= 0 {
+		return now
+	}
+	t := time.UnixMilli(lastSeen)
+	if t.After(now) {
+		return now
+	}
+	return t
+}
+
 func (d *DnsRecords) purgeStaleRecords(maxAgeSeconds float64) {
 	now := time.Now()
 	for k, v := range d.ARecords {
 		diff := now.Sub(v.timestamp)
-		if diff.Seconds() > maxAgeSeconds {
+		if diff.Seconds() > recordMaxAge(v.maxAge, maxAgeSeconds) {
 			delete(d.ARecords, k)
 			log.Debugf("purging stale record: %s", k)
 		}
 	}
 	for k, v := range d.PtrRecords {
 		diff := now.Sub(v.timestamp)
-		if diff.Seconds() > maxAgeSeconds {
+		if diff.Seconds() > recordMaxAge(v.maxAge, maxAgeSeconds) {
 			delete(d.PtrRecords, k)
 			log.Debugf("purging stale record: %s", k)
 		}
 	}
 }
 
-// addFallbackRecord adds wildcard fallback records for unresolved queries in each zone
-func (o *Omada) addFallbackRecord(zones map[string]*file.Zone, dnsDomain string, domainRecords DnsRecords) {
-	if o.config.fallback == "" {
-		return // No fallback configured
+// recordMaxAge returns the max age of a record in seconds, using the default
+// unless the record has its own max age
+func recordMaxAge(maxAge time.Duration, defaultSeconds float64) float64 {
+	if maxAge > 0 {
+		return maxAge.Seconds()
 	}
-
-	log.Debugf("update: adding fallback %s record for zone: %s", o.config.fallback, dnsDomain)
-
-	// Determine fallback IP based on configuration
-	var fallbackIP net.IP
-
-	// Case 1: fallback is an IP address
-	if ip := net.ParseIP(o.config.fallback); ip != nil {
-		fallbackIP = ip
-		log.Debugf("update: fallback is IP: %s", fallbackIP.String())
-	} else {
-		// Case 2 & 3: fallback is FQDN or hostname
-		var targetFQDN string
-
-		// Check if it contains dots (FQDN) or is just a hostname
-		if strings.Contains(o.config.fallback, ".") {
-			// Case 2: FQDN - use as-is
-			targetFQDN = dns.Fqdn(o.config.fallback)
-		} else {
-			// Case 3: hostname - append current zone
-			targetFQDN = fmt.Sprintf("%s.%s", o.config.fallback, dnsDomain)
-		}
-
-		log.Debugf("update: looking for fallback FQDN: %s", targetFQDN)
-
-		// Search all zones for the target FQDN
-		fallbackIP = o.resolveInZones(targetFQDN)
-		if fallbackIP == nil {
-			log.Warningf("update: fallback '%s' not found in any zone, skipping fallback for zone %s",
-				o.config.fallback, dnsDomain)
-			return
-		}
-
-		log.Debugf("update: found fallback IP: %s for FQDN: %s", fallbackIP.String(), targetFQDN)
-	}
-
-	// Create wildcard A record for this zone pointing to the fallback IP
-	wildcardName := fmt.Sprintf("*.%s", dnsDomain)
-	fallbackRecord := &dns.A{
-		Hdr: dns.RR_Header{
-			Name:   wildcardName,
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    60,
-		},
-		A: fallbackIP,
-	}
-	zones[dnsDomain].Insert(fallbackRecord)
-	log.Debugf("update: added wildcard fallback record: %s -> %s", wildcardName, fallbackIP.String())
-}
-
-// resolveInZones searches all current records for an FQDN and returns its IP
-func (o *Omada) resolveInZones(targetFQDN string) net.IP {
-	// Search in current records map
-	for _, domainRecords := range o.records {
-		for fqdn, aRecord := range domainRecords.ARecords {
-			if fqdn == targetFQDN {
-				return aRecord.record.A
-			}
-		}
-	}
-	return nil
+	return defaultSeconds
 }
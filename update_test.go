@@ -1,19 +1,36 @@
 package coredns_omada
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	omada "github.com/dougbw/go-omada"
 	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
 )
 
 func setupTestServer() *httptest.Server {
+	return setupFailingTestServer(func(path string) bool { return false })
+}
+
+// setupFailingTestServer returns a mock controller which responds with an
+// error for any request path where fail returns true
+func setupFailingTestServer(fail func(path string) bool) *httptest.Server {
+	return httptest.NewServer(testControllerHandler(fail))
+}
+
+// testControllerHandler serves the mock controller's api from the test data
+func testControllerHandler(fail func(path string) bool) http.HandlerFunc {
 
 	controllerId := "123bee230c77bbb45d9c8545d04d700a"
 	siteId := "Default"
@@ -23,31 +40,36 @@ func setupTestServer() *httptest.Server {
 	pathDevices := fmt.Sprintf("/%s/api/v2/sites/%s/devices", controllerId, siteId)
 	pathNetworks := fmt.Sprintf("/%s/api/v2/sites/%s/setting/lan/networks", controllerId, siteId)
 	pathDhcp := fmt.Sprintf("/%s/api/v2/sites/%s/setting/service/dhcp", controllerId, siteId)
+	pathKnownClients := fmt.Sprintf("/%s/api/v2/sites/%s/insight/clients", controllerId, siteId)
 
 	responses := map[string]string{
-		"/api/info":  "./test-data/info-response.json",
-		pathLogin:    "./test-data/login-response.json",
-		pathUsers:    "./test-data/users-response.json",
-		pathClients:  "./test-data/clients-response.json",
-		pathDevices:  "./test-data/devices-response.json",
-		pathNetworks: "./test-data/networks-response.json",
-		pathDhcp:     "./test-data/dhcp-reservation-response.json",
+		"/api/info":      "./test-data/info-response.json",
+		pathLogin:        "./test-data/login-response.json",
+		pathUsers:        "./test-data/users-response.json",
+		pathClients:      "./test-data/clients-response.json",
+		pathDevices:      "./test-data/devices-response.json",
+		pathNetworks:     "./test-data/networks-response.json",
+		pathDhcp:         "./test-data/dhcp-reservation-response.json",
+		pathKnownClients: "./test-data/known-clients-response.json",
 	}
 
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
 		responseFile, ok := responses[r.URL.Path]
 		if !ok {
 			log.Fatalf("Unexpected request path on mock server: %s", r.URL.Path)
 		}
+		if fail(r.URL.Path) {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("internal server error"))
+			return
+		}
 		response, err := os.ReadFile(responseFile)
 		if err != nil {
 			log.Fatal(err)
 		}
 		w.WriteHeader(http.StatusOK)
 		w.Write(response)
-	}))
-
-	return server
+	}
 }
 
 func TestUpdate(t *testing.T) {
@@ -69,8 +91,8 @@ func TestUpdate(t *testing.T) {
 		t.Fatalf("test failure on 'TestUpdate/controllerInit': %v", err)
 	}
 
-	testOmada.config.refresh_minutes = 1
-	testOmada.config.refresh_login_hours = 24
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
 	testOmada.config.resolve_clients = true
 	testOmada.config.resolve_devices = true
 	testOmada.config.resolve_dhcp_reservations = true
@@ -89,7 +111,7 @@ func TestUpdate(t *testing.T) {
 
 	assert.Len(t, testOmada.zoneNames, 3)
 	assert.Len(t, testOmada.zones, 3)
-	assert.Equal(t, 13, testOmada.zones["omada.home."].Count)
+	assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
 
 	tests := []testCases{
 		{ // foward resolve: client
@@ -153,13 +175,13 @@ func TestUpdateWithFallback(t *testing.T) {
 	}
 
 	// Configure with fallback IP
-	testOmada.config.refresh_minutes = 1
-	testOmada.config.refresh_login_hours = 24
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
 	testOmada.config.resolve_clients = true
 	testOmada.config.resolve_devices = true
 	testOmada.config.resolve_dhcp_reservations = true
 	testOmada.config.stale_record_duration, _ = time.ParseDuration("5m")
-	testOmada.config.fallback = "10.0.0.200" // Fallback IP
+	testOmada.config.fallback = fallbackConfig{targets: []string{"10.0.0.200"}} // Fallback IP
 
 	var sites []string
 	for s := range testOmada.controller.Sites {
@@ -176,7 +198,7 @@ func TestUpdateWithFallback(t *testing.T) {
 	assert.Len(t, testOmada.zoneNames, 3)
 	assert.Len(t, testOmada.zones, 3)
 	// Should have one more record due to wildcard fallback
-	assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
+	assert.Equal(t, 15, testOmada.zones["omada.home."].Count)
 
 	tests := []testCases{
 		{ // existing record should work normally
@@ -222,13 +244,13 @@ func TestUpdateWithLocalHostnameFallback(t *testing.T) {
 	}
 
 	// Configure with local hostname fallback that should resolve to existing record
-	testOmada.config.refresh_minutes = 1
-	testOmada.config.refresh_login_hours = 24
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
 	testOmada.config.resolve_clients = true
 	testOmada.config.resolve_devices = true
 	testOmada.config.resolve_dhcp_reservations = true
 	testOmada.config.stale_record_duration, _ = time.ParseDuration("5m")
-	testOmada.config.fallback = "client-001" // Should resolve to existing client record
+	testOmada.config.fallback = fallbackConfig{targets: []string{"client-001"}} // Should resolve to existing client record
 
 	var sites []string
 	for s := range testOmada.controller.Sites {
@@ -242,7 +264,7 @@ func TestUpdateWithLocalHostnameFallback(t *testing.T) {
 	}
 
 	// Should have one more record due to wildcard fallback
-	assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
+	assert.Equal(t, 15, testOmada.zones["omada.home."].Count)
 
 	tests := []testCases{
 		{ // existing record should work normally
@@ -293,13 +315,13 @@ func TestUpdateWithFqdnFallback(t *testing.T) {
 	}
 
 	// Configure with FQDN fallback that should resolve to existing record
-	testOmada.config.refresh_minutes = 1
-	testOmada.config.refresh_login_hours = 24
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
 	testOmada.config.resolve_clients = true
 	testOmada.config.resolve_devices = true
 	testOmada.config.resolve_dhcp_reservations = true
 	testOmada.config.stale_record_duration, _ = time.ParseDuration("5m")
-	testOmada.config.fallback = "client-001.omada.home." // Should resolve to existing client FQDN
+	testOmada.config.fallback = fallbackConfig{targets: []string{"client-001.omada.home."}} // Should resolve to existing client FQDN
 
 	var sites []string
 	for s := range testOmada.controller.Sites {
@@ -313,7 +335,7 @@ func TestUpdateWithFqdnFallback(t *testing.T) {
 	}
 
 	// Should have one more record due to wildcard fallback
-	assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
+	assert.Equal(t, 15, testOmada.zones["omada.home."].Count)
 
 	tests := []testCases{
 		{ // existing record should work normally
@@ -351,13 +373,13 @@ func TestUpdateWithHostnameNotFoundFallback(t *testing.T) {
 	}
 
 	// Configure with hostname fallback that won't be found (testing warning case)
-	testOmada.config.refresh_minutes = 1
-	testOmada.config.refresh_login_hours = 24
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
 	testOmada.config.resolve_clients = true
 	testOmada.config.resolve_devices = true
 	testOmada.config.resolve_dhcp_reservations = true
 	testOmada.config.stale_record_duration, _ = time.ParseDuration("5m")
-	testOmada.config.fallback = "nonexistent-host" // Should not be found
+	testOmada.config.fallback = fallbackConfig{targets: []string{"nonexistent-host"}} // Should not be found
 
 	var sites []string
 	for s := range testOmada.controller.Sites {
@@ -371,7 +393,7 @@ func TestUpdateWithHostnameNotFoundFallback(t *testing.T) {
 	}
 
 	// Should NOT have extra record since fallback wasn't found
-	assert.Equal(t, 13, testOmada.zones["omada.home."].Count)
+	assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
 
 	tests := []testCases{
 		{ // existing record should work normally
@@ -389,3 +411,522 @@ func TestUpdateWithHostnameNotFoundFallback(t *testing.T) {
 	executeTestCases(t, testOmada, tests)
 
 }
+
+func TestUpdatePartialFailure(t *testing.T) {
+
+	var failDhcp, failAll atomic.Bool
+	testServer := setupFailingTestServer(func(path string) bool {
+		if strings.HasPrefix(path, "/api/") || strings.HasSuffix(path, "/login") || strings.HasSuffix(path, "/users/current") {
+			return false
+		}
+		return failAll.Load() || (failDhcp.Load() && strings.HasSuffix(path, "/setting/service/dhcp"))
+	})
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdatePartialFailure/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.Site = []string{".*"}
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdatePartialFailure/controllerInit': %v", err)
+	}
+	assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
+
+	// dhcp reservations fail: records from the last successful fetch are kept
+	failDhcp.Store(true)
+	err = testOmada.updateZones()
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdatePartialFailure/updateZones': %v", err)
+	}
+	assert.Equal(t, 14, testOmada.zones["omada.home."].Count)
+
+	tests := []testCases{
+		{ // client from a healthy source
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+		{ // reservation kept from the previous refresh
+			qname:      "client-01.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-01.omada.home.	60	IN	A	10.0.0.101"},
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+
+	// the kept records are not refreshed, so they are purged once stale while
+	// records from healthy sources are refreshed
+	ageRecords(testOmada.records, 2*time.Hour)
+	err = testOmada.updateZones()
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdatePartialFailure/updateZones': %v", err)
+	}
+	assert.Equal(t, 10, testOmada.zones["omada.home."].Count, "the four reservation records are purged")
+	executeTestCases(t, testOmada, []testCases{
+		tests[0],
+		{
+			qname:        "client-01.omada.home.",
+			qtype:        dns.TypeA,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+	})
+
+	// every source fails: the refresh is reported as failed
+	failAll.Store(true)
+	err = testOmada.updateZones()
+	assert.Error(t, err)
+}
+
+// ageRecords moves the timestamps of all records into the past
+func ageRecords(records map[string]DnsRecords, age time.Duration) {
+	for _, domainRecords := range records {
+		for k, v := range domainRecords.ARecords {
+			v.timestamp = v.timestamp.Add(-age)
+			domainRecords.ARecords[k] = v
+		}
+		for k, v := range domainRecords.PtrRecords {
+			v.timestamp = v.timestamp.Add(-age)
+			domainRecords.PtrRecords[k] = v
+		}
+	}
+}
+
+func TestFetchSiteUnknownSite(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestFetchSiteUnknownSite/NewOmada': %v", err)
+	}
+	testOmada.config.resolve_clients = true
+	if err := testOmada.controller.GetControllerInfo(); err != nil {
+		t.Fatalf("test failure on 'TestFetchSiteUnknownSite/GetControllerInfo': %v", err)
+	}
+	if err := testOmada.login(); err != nil {
+		t.Fatalf("test failure on 'TestFetchSiteUnknownSite/login': %v", err)
+	}
+
+	home := testOmada.fetchSite(ot.NoopTracer{}.StartSpan("test"), "Home", siteData{})
+	assert.Empty(t, home.failures)
+	assert.NotEmpty(t, home.data.clients)
+
+	// a site which disappeared from the session keeps its previous data
+	// instead of being filled with another site's data
+	previous := siteData{clients: []omada.Client{{MAC: "AA-AA-AA-AA-AA-99", Name: "branch-laptop"}}}
+	gone := testOmada.fetchSite(ot.NoopTracer{}.StartSpan("test"), "Branch", previous)
+	assert.Equal(t, 1, gone.attempts)
+	assert.Len(t, gone.failures, 1)
+	assert.Equal(t, previous, gone.data)
+}
+
+func TestUpdateDiscoversSites(t *testing.T) {
+
+	// the Branch site is added to the controller partway through the test,
+	// it serves the Home site's data with its own domain
+	var branch atomic.Bool
+	var logins atomic.Int32
+	controller := testControllerHandler(func(path string) bool { return false })
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/login") {
+			logins.Add(1)
+		}
+		if !branch.Load() {
+			controller(w, r)
+			return
+		}
+		rec := httptest.NewRecorder()
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/users/current"):
+			controller(rec, r)
+			w.Write(bytes.Replace(rec.Body.Bytes(), []byte(`"sites": [`), []byte(`"sites": [{"name": "Branch", "key": "Branch"},`), 1))
+		case strings.Contains(r.URL.Path, "/sites/Branch/"):
+			home := r.Clone(r.Context())
+			home.URL.Path = strings.Replace(r.URL.Path, "/sites/Branch/", "/sites/Default/", 1)
+			controller(rec, home)
+			w.Write(bytes.ReplaceAll(rec.Body.Bytes(), []byte("omada.home"), []byte("omada.branch")))
+		default:
+			controller(w, r)
+		}
+	}))
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.Site = []string{".*"}
+	testOmada.config.site_filter, _ = newSiteFilter([]string{".*"}, nil, false)
+	testOmada.config.resolve_clients = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+
+	// set up without the background loops, the test changes the config
+	if err := testOmada.controller.GetControllerInfo(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/GetControllerInfo': %v", err)
+	}
+	if err := testOmada.login(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/login': %v", err)
+	}
+	testOmada.sites = testOmada.discoverSites()
+	if err := testOmada.updateZones(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/updateZones': %v", err)
+	}
+	assert.Equal(t, []string{"Home"}, testOmada.sites)
+
+	// a site missing from the current list is picked up on the next refresh
+	testOmada.sites = nil
+	if err := testOmada.updateZones(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/updateZones': %v", err)
+	}
+	assert.Equal(t, []string{"Home"}, testOmada.sites)
+
+	// a site added to the controller is fetched after the site list is refreshed
+	branch.Store(true)
+	if err := testOmada.refreshSiteList(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/refreshSiteList': %v", err)
+	}
+	if err := testOmada.updateZones(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/updateZones': %v", err)
+	}
+	assert.Equal(t, []string{"Branch", "Home"}, testOmada.sites)
+	executeTestCases(t, testOmada, []testCases{
+		{
+			qname:      "client-001.omada.branch.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.branch.	60	IN	A	10.0.0.101"},
+		},
+		{
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+	})
+
+	// no matching sites keeps the current list
+	testOmada.config.site_filter, _ = newSiteFilter([]string{"^Office$"}, nil, false)
+	if err := testOmada.updateZones(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/updateZones': %v", err)
+	}
+	assert.Equal(t, []string{"Branch", "Home"}, testOmada.sites)
+
+	// a site removed from the controller is no longer fetched
+	branch.Store(false)
+	testOmada.config.site_filter, _ = newSiteFilter([]string{".*"}, nil, false)
+	if err := testOmada.refreshSiteList(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/refreshSiteList': %v", err)
+	}
+	if err := testOmada.updateZones(); err != nil {
+		t.Fatalf("test failure on 'TestUpdateDiscoversSites/updateZones': %v", err)
+	}
+	assert.Equal(t, []string{"Home"}, testOmada.sites)
+	assert.NotContains(t, testOmada.siteCache, "Branch")
+
+	// the site list is read with a single session rather than by logging in again
+	assert.Equal(t, int32(2), logins.Load())
+}
+
+func TestUpdateWithClientFilter(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithClientFilter/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+	testOmada.config.client_filter.addRule([]string{"exclude", "wireless", "true"}, clientFilterFields)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithClientFilter/controllerInit': %v", err)
+	}
+
+	// one less record for each wireless client
+	assert.Equal(t, 12, testOmada.zones["omada.home."].Count)
+
+	tests := []testCases{
+		{ // wired client
+			qname:      "win10-vm.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"win10-vm.omada.home.	60	IN	A	10.0.0.102"},
+		},
+		{ // wireless client is excluded
+			qname:        "google-nest-mini.omada.home.",
+			qtype:        dns.TypeA,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+}
+
+func TestLastSeenTime(t *testing.T) {
+
+	now := time.UnixMilli(1705581400000)
+
+	assert.Equal(t, time.UnixMilli(1705581367678), lastSeenTime(1705581367678, now))
+	assert.Equal(t, now, lastSeenTime(0, now))
+	assert.Equal(t, now, lastSeenTime(1705581500000, now))
+}
+
+func TestUpdateWithClientLastSeen(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithClientLastSeen/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_devices = true
+	testOmada.config.resolve_dhcp_reservations = true
+	testOmada.config.clients_active_only = true
+	testOmada.config.clients_use_last_seen = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithClientLastSeen/controllerInit': %v", err)
+	}
+
+	// the test clients were last seen long ago so they are purged as stale
+	assert.Equal(t, 10, testOmada.zones["omada.home."].Count)
+
+	tests := []testCases{
+		{ // client not seen within the stale record duration
+			qname:        "win10-vm.omada.home.",
+			qtype:        dns.TypeA,
+			wantRetCode:  dns.RcodeServerFailure,
+			wantMsgRCode: dns.RcodeServerFailure,
+		},
+		{ // dhcp reservations are unaffected
+			qname:      "client-01.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-01.omada.home.	60	IN	A	10.0.0.101"},
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+}
+
+func TestUpdateWithClientsActiveOnly(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		activeOnly bool
+		wantCount  int
+		test       testCases
+	}{
+		{
+			name:       "all clients",
+			activeOnly: false,
+			wantCount:  14,
+			test: testCases{
+				qname:      "sleeping-tablet.omada.home.",
+				qtype:      dns.TypeA,
+				wantAnswer: []string{"sleeping-tablet.omada.home.	60	IN	A	10.0.0.104"},
+			},
+		},
+		{
+			name:       "active clients only",
+			activeOnly: true,
+			wantCount:  13,
+			test: testCases{
+				qname:        "sleeping-tablet.omada.home.",
+				qtype:        dns.TypeA,
+				wantRetCode:  dns.RcodeServerFailure,
+				wantMsgRCode: dns.RcodeServerFailure,
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+
+			testServer := setupTestServer()
+			defer testServer.Close()
+
+			testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+			if err != nil {
+				t.Fatalf("test failure on 'TestUpdateWithClientsActiveOnly/NewOmada': %v", err)
+			}
+			testOmada.Next = testHandler()
+			testOmada.config.refresh = time.Minute
+			testOmada.config.login_refresh = 24 * time.Hour
+			testOmada.config.resolve_clients = true
+			testOmada.config.resolve_devices = true
+			testOmada.config.resolve_dhcp_reservations = true
+			testOmada.config.clients_active_only = tc.activeOnly
+			testOmada.config.stale_record_duration = 5 * time.Minute
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			err = testOmada.controllerInit(ctx)
+			if err != nil {
+				t.Fatalf("test failure on 'TestUpdateWithClientsActiveOnly/controllerInit': %v", err)
+			}
+
+			assert.Equal(t, tc.wantCount, testOmada.zones["omada.home."].Count)
+			executeTestCases(t, testOmada, []testCases{tc.test})
+		})
+	}
+}
+
+func TestUpdateWithKnownClients(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithKnownClients/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Minute
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.resolve_clients = true
+	testOmada.config.resolve_known_clients = true
+	testOmada.config.known_clients_ttl = 5 * time.Minute
+	testOmada.config.known_clients_retention = 100 * 365 * 24 * time.Hour
+	testOmada.config.stale_record_duration = 5 * time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateWithKnownClients/controllerInit': %v", err)
+	}
+
+	tests := []testCases{
+		{ // offline known client
+			qname:      "old-laptop.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"old-laptop.omada.home.	300	IN	A	10.0.0.150"},
+		},
+		{ // the active client takes precedence over the known client
+			qname:      "client-001.omada.home.",
+			qtype:      dns.TypeA,
+			wantAnswer: []string{"client-001.omada.home.	60	IN	A	10.0.0.101"},
+		},
+	}
+	executeTestCases(t, testOmada, tests)
+}
+
+func TestAddKnownClientRecords(t *testing.T) {
+
+	testOmada := &Omada{}
+	testOmada.config.known_clients_ttl = 5 * time.Minute
+	testOmada.config.known_clients_retention = 24 * time.Hour
+	testOmada.config.stale_record_duration = 10 * time.Minute
+
+	dnsDomain := "omada.home."
+	records := map[string]DnsRecords{
+		dnsDomain: {ARecords: make(map[string]ARecord), PtrRecords: make(map[string]PtrRecord)},
+		ptrZone:   {ARecords: make(map[string]ARecord), PtrRecords: make(map[string]PtrRecord)},
+	}
+	network := omada.OmadaNetwork{Name: "LAN", Domain: "omada.home", Subnet: "10.0.0.1/24"}
+	_, subnet, _ := net.ParseCIDR(network.Subnet)
+
+	now := time.Now()
+	knownClients := []omada.Client{
+		{ // offline for an hour
+			MAC:      "AA-AA-AA-AA-AA-10",
+			Name:     "Sleeping Laptop",
+			Ip:       "10.0.0.110",
+			LastSeen: now.Add(-time.Hour).UnixMilli(),
+		},
+		{ // offline for longer than the retention
+			MAC:      "AA-AA-AA-AA-AA-11",
+			Name:     "old-phone",
+			Ip:       "10.0.0.111",
+			LastSeen: now.Add(-48 * time.Hour).UnixMilli(),
+		},
+		{ // different network
+			MAC:  "AA-AA-AA-AA-AA-12",
+			Name: "work-laptop",
+			Ip:   "10.0.100.10",
+		},
+	}
+
+	testOmada.addKnownClientRecords(records, network, subnet, dnsDomain, knownClients, map[string]string{"AA-AA-AA-AA-AA-10": "Default"}, now)
+	assert.Len(t, records[dnsDomain].ARecords, 2)
+
+	laptop := records[dnsDomain].ARecords["sleeping-laptop.omada.home."]
+	assert.Equal(t, uint32(300), laptop.record.Hdr.Ttl)
+	assert.Equal(t, 24*time.Hour, laptop.maxAge)
+	assert.Equal(t, recordInfo{source: "known client", mac: "AA-AA-AA-AA-AA-10", site: "Default"}, laptop.recordInfo)
+
+	// the retention applies instead of stale_record_duration
+	domainRecords := records[dnsDomain]
+	domainRecords.purgeStaleRecords(testOmada.config.stale_record_duration.Seconds())
+	assert.Len(t, domainRecords.ARecords, 1)
+	assert.Contains(t, domainRecords.ARecords, "sleeping-laptop.omada.home.")
+}
+
+func TestUpdateZoneLoopForcedRefresh(t *testing.T) {
+
+	testServer := setupTestServer()
+	defer testServer.Close()
+
+	testOmada, err := NewOmada(context.TODO(), testServer.URL, "test", "test")
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateZoneLoopForcedRefresh/NewOmada': %v", err)
+	}
+	testOmada.Next = testHandler()
+	testOmada.config.refresh = time.Hour
+	testOmada.config.login_refresh = 24 * time.Hour
+	testOmada.config.refresh_debounce = 200 * time.Millisecond
+	testOmada.config.resolve_clients = true
+	testOmada.config.stale_record_duration = 5 * time.Minute
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err = testOmada.controllerInit(ctx)
+	if err != nil {
+		t.Fatalf("test failure on 'TestUpdateZoneLoopForcedRefresh/controllerInit': %v", err)
+	}
+
+	lastAttempt := func() time.Time {
+		testOmada.zMu.RLock()
+		defer testOmada.zMu.RUnlock()
+		return testOmada.status.LastAttempt
+	}
+	initial := lastAttempt()
+
+	// the forced refresh waits for the debounce interval
+	assert.True(t, testOmada.requestRefresh())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, initial, lastAttempt())
+
+	assert.Eventually(t, func() bool { return lastAttempt().After(initial) }, 2*time.Second, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, lastAttempt().Sub(initial), 150*time.Millisecond)
+}
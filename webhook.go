@@ -0,0 +1,153 @@
+package coredns_omada
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// webhookEvent is the json body posted to the webhooks
+type webhookEvent struct {
+	Time      time.Time      `json:"time"`
+	Event     string         `json:"event"` // records_changed, controller_unreachable or controller_recovered
+	Changes   []recordChange `json:"changes,omitempty"`
+	Operation string         `json:"operation,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// webhookQueueSize is the number of events which can wait for delivery before
+// new events are dropped
+const webhookQueueSize = 64
+
+// webhookSink posts events to the configured webhooks in the background so a
+// slow or unreachable receiver never delays a refresh
+type webhookSink struct {
+	urls       []string
+	secret     string
+	retries    int
+	retryDelay time.Duration
+	client     *http.Client
+	queue      chan webhookEvent
+}
+
+func newWebhookSink(c config) *webhookSink {
+	return &webhookSink{
+		urls:       c.webhooks,
+		secret:     c.webhook_secret,
+		retries:    c.webhook_retries,
+		retryDelay: time.Second,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		queue:      make(chan webhookEvent, webhookQueueSize),
+	}
+}
+
+// send queues an event for delivery, dropping it when the queue is full
+func (s *webhookSink) send(event webhookEvent) {
+	select {
+	case s.queue <- event:
+	default:
+		log.Warningf("webhook: queue is full, dropping %s event", event.Event)
+	}
+}
+
+// run delivers queued events to every webhook until the context is cancelled
+func (s *webhookSink) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-s.queue:
+			body, err := json.Marshal(event)
+			if err != nil {
+				log.Errorf("webhook: failed to encode %s event: %v", event.Event, err)
+				continue
+			}
+			for _, url := range s.urls {
+				if err := s.deliver(ctx, url, event.Event, body); err != nil {
+					log.Warningf("webhook: failed to deliver %s event to %s: %v", event.Event, url, err)
+				}
+			}
+		}
+	}
+}
+
+// deliver posts the body to a webhook, retrying with an increasing delay when
+// the request fails or the receiver returns a server error
+func (s *webhookSink) deliver(ctx context.Context, url string, event string, body []byte) error {
+
+	delay := s.retryDelay
+	var err error
+	for attempt := 0; attempt <= s.retries; attempt++ {
+		if attempt > 0 {
+			log.Debugf("webhook: retrying %s event to %s in %s: %v", event, url, delay, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+
+		var retry bool
+		retry, err = s.post(ctx, url, event, body)
+		if err == nil {
+			log.Debugf("webhook: delivered %s event to %s", event, url)
+			return nil
+		}
+		if !retry {
+			return err
+		}
+	}
+	return err
+}
+
+// post makes a single delivery attempt and reports whether a failure may be retried
+func (s *webhookSink) post(ctx context.Context, url string, event string, body []byte) (bool, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Omada-Event", event)
+	if s.secret != "" {
+		req.Header.Set("X-Omada-Signature", "sha256="+signWebhook(s.secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	return false, fmt.Errorf("unexpected status: %s", resp.Status)
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of the body
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyHealth sends a webhook event when the controller becomes unreachable or recovers
+func (o *Omada) notifyHealth(op string, err error) {
+
+	event := webhookEvent{Time: time.Now(), Event: "controller_recovered", Operation: op}
+	if err != nil {
+		event.Event = "controller_unreachable"
+		event.Error = err.Error()
+	}
+	o.webhook.send(event)
+}
@@ -0,0 +1,150 @@
+package coredns_omada
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupTestReceiver starts a webhook receiver which answers with the given
+// status codes in turn and passes every delivered event to the channel
+func setupTestReceiver(t *testing.T, statuses ...int) (*httptest.Server, chan webhookEvent) {
+
+	events := make(chan webhookEvent, 10)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(requests.Add(1)) - 1
+		status := http.StatusOK
+		if n < len(statuses) {
+			status = statuses[n]
+		}
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "sha256="+signWebhook("secret", body), r.Header.Get("X-Omada-Signature"))
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			return
+		}
+		var event webhookEvent
+		assert.NoError(t, json.Unmarshal(body, &event))
+		assert.Equal(t, event.Event, r.Header.Get("X-Omada-Event"))
+		events <- event
+	}))
+	t.Cleanup(server.Close)
+	return server, events
+}
+
+func receiveEvent(t *testing.T, events chan webhookEvent) webhookEvent {
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook event was not delivered")
+	}
+	return webhookEvent{}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		statuses []int
+		retries  int
+		wantErr  bool
+		wantSent int
+	}{
+		{"success", nil, 3, false, 1},
+		{"retried server error", []int{http.StatusInternalServerError, http.StatusTooManyRequests}, 3, false, 3},
+		{"retries exhausted", []int{http.StatusBadGateway, http.StatusBadGateway}, 1, true, 2},
+		{"client error is not retried", []int{http.StatusBadRequest}, 3, true, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := int(sent.Add(1)) - 1
+				if n < len(tt.statuses) {
+					w.WriteHeader(tt.statuses[n])
+				}
+			}))
+			defer server.Close()
+
+			sink := newWebhookSink(config{webhooks: []string{server.URL}, webhook_retries: tt.retries})
+			sink.retryDelay = time.Millisecond
+			err := sink.deliver(context.Background(), server.URL, "records_changed", []byte("{}"))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, int32(tt.wantSent), sent.Load())
+		})
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+
+	server, events := setupTestReceiver(t, http.StatusServiceUnavailable)
+
+	o := testDynamicOmada()
+	o.config.webhooks = []string{server.URL}
+	o.config.webhook_secret = "secret"
+	o.config.webhook_retries = 3
+	o.webhook = newWebhookSink(o.config)
+	o.webhook.retryDelay = time.Millisecond
+	o.health.notify = o.notifyHealth
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go o.webhook.run(ctx)
+
+	// record changes are delivered after the failed first attempt is retried
+	now := time.Now()
+	o.publishChanges([]recordChange{{Time: now, Action: "added", Name: "vm1.omada.test.", Type: "A", Value: "192.168.0.150", Source: "dynamic"}})
+	event := receiveEvent(t, events)
+	assert.Equal(t, "records_changed", event.Event)
+	assert.True(t, event.Time.Equal(now))
+	assert.Len(t, event.Changes, 1)
+	assert.Equal(t, "vm1.omada.test.", event.Changes[0].Name)
+
+	// the controller becoming unreachable is only sent once per outage
+	o.health.failure("refresh", errors.New("connection refused"))
+	o.health.failure("refresh", errors.New("connection refused"))
+	o.health.success("refresh")
+
+	event = receiveEvent(t, events)
+	assert.Equal(t, "controller_unreachable", event.Event)
+	assert.Equal(t, "refresh", event.Operation)
+	assert.Equal(t, "connection refused", event.Error)
+
+	event = receiveEvent(t, events)
+	assert.Equal(t, "controller_recovered", event.Event)
+	assert.Equal(t, "refresh", event.Operation)
+	assert.Empty(t, event.Error)
+
+	// no changes, no event
+	o.publishChanges(nil)
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+
+	sink := newWebhookSink(config{})
+	for range webhookQueueSize + 1 {
+		sink.send(webhookEvent{Event: "records_changed"})
+	}
+	assert.Len(t, sink.queue, webhookQueueSize)
+}